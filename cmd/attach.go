@@ -0,0 +1,211 @@
+/* attach.go: attach files to messages
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"fmt"
+	. "github.com/githubert/lettersnail/common"
+	"github.com/jordan-wright/email"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Content type of attachments whose type is not known by their extension.
+const DEFAULT_ATTACHMENT_TYPE = "application/octet-stream"
+
+// A file to attach, as given by an `attach:` line.
+type attachment struct {
+	// The path as given, and where the file actually is.
+	name string
+	path string
+
+	contentType string
+}
+
+// Parse the `attach:` lines of the message. Each is a path, absolute or
+// relative to the folder of the message file, optionally followed by a
+// content type, like "invoice.txt; application/pdf".
+func messageAttachments(message *Message) ([]attachment, error) {
+	dir := message.Dir
+
+	if dir == "" {
+		dir = filepath.Join(message.Get(CONF_WORKDIR), DIR_TODO)
+	}
+
+	attachments := []attachment{}
+
+	for _, value := range message.Conf.GetList(CONF_ATTACH) {
+		a := attachment{name: value}
+
+		// File names may contain semicolons as well, only a type/subtype
+		// after one counts as content type.
+		for i, c := range value {
+			if c != ';' {
+				continue
+			}
+
+			if contentType := strings.TrimSpace(value[i+1:]); isContentType(contentType) {
+				a.name = strings.TrimSpace(value[:i])
+				a.contentType = contentType
+				break
+			}
+		}
+
+		if a.name == "" {
+			return nil, fmt.Errorf("no file in '%s: %s'", CONF_ATTACH, value)
+		}
+
+		a.path = a.name
+
+		if !filepath.IsAbs(a.path) {
+			a.path = filepath.Join(dir, a.path)
+		}
+
+		if a.contentType == "" {
+			a.contentType = mime.TypeByExtension(filepath.Ext(a.path))
+		}
+
+		if a.contentType == "" {
+			a.contentType = DEFAULT_ATTACHMENT_TYPE
+		}
+
+		attachments = append(attachments, a)
+	}
+
+	return attachments, nil
+}
+
+// Whether `value` is a content type like "text/plain; charset=utf-8".
+func isContentType(value string) bool {
+	mediaType, _, err := mime.ParseMediaType(value)
+
+	if err != nil {
+		return false
+	}
+
+	parts := strings.Split(mediaType, "/")
+
+	return len(parts) == 2 && parts[0] != "" && parts[1] != ""
+}
+
+// Check that all attachments of the message can be read.
+func verifyAttachments(message *Message) []error {
+	attachments, err := messageAttachments(message)
+
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+
+	for _, a := range attachments {
+		f, err := os.Open(a.path)
+
+		if err == nil {
+			var info os.FileInfo
+
+			if info, err = f.Stat(); err == nil && !info.Mode().IsRegular() {
+				err = fmt.Errorf("%s is not a regular file", a.path)
+			}
+
+			f.Close()
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot attach %s: %s", a.name, err.Error()))
+		}
+	}
+
+	return errs
+}
+
+// Add the attachments of the message to the email.
+func attachFiles(message *Message, e *email.Email) error {
+	attachments, err := messageAttachments(message)
+
+	if err != nil {
+		return err
+	}
+
+	for _, a := range attachments {
+		f, err := os.Open(a.path)
+
+		if err != nil {
+			return fmt.Errorf("cannot attach %s: %s", a.name, err.Error())
+		}
+
+		_, err = e.Attach(f, filepath.Base(a.path), a.contentType)
+		f.Close()
+
+		if err != nil {
+			return fmt.Errorf("cannot attach %s: %s", a.name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Copy the attachments kept in the folder of the message along, when the
+// message is moved to the folder `to` of the working directory. Relative
+// paths of the message then still work. Attachments elsewhere are referenced
+// as they are. Files already in `to` are only replaced with `overwrite`.
+func copyAttachments(message *Message, to string, overwrite bool) error {
+	attachments, err := messageAttachments(message)
+
+	if err != nil {
+		return err
+	}
+
+	from := message.Dir
+
+	if from == "" {
+		from = filepath.Join(message.Get(CONF_WORKDIR), DIR_TODO)
+	}
+
+	dst := filepath.Join(message.Get(CONF_WORKDIR), to)
+
+	for _, a := range attachments {
+		if filepath.IsAbs(a.name) {
+			continue
+		}
+
+		rel, err := filepath.Rel(from, a.path)
+
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+
+		target := filepath.Join(dst, rel)
+
+		if _, err := os.Stat(target); err == nil && !overwrite {
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+			return err
+		}
+
+		if _, err := copyFile(a.path, target, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+/* attach_test.go: tests for file attachments
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"fmt"
+	. "github.com/githubert/lettersnail/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMessageAttachments(t *testing.T) {
+	message := newTestMessage(map[string]string{
+		CONF_ATTACH: "notes.txt\n/tmp/report; application/pdf\ndata.unknownext\na;b.txt\nc; d.txt; text/plain",
+	})
+	message.Dir = "/letters"
+
+	attachments, err := messageAttachments(message)
+	require.Nil(t, err)
+
+	assert.Equal(t, []attachment{
+		{"notes.txt", "/letters/notes.txt", "text/plain; charset=utf-8"},
+		{"/tmp/report", "/tmp/report", "application/pdf"},
+		{"data.unknownext", "/letters/data.unknownext", DEFAULT_ATTACHMENT_TYPE},
+		// Semicolons not followed by a content type are part of the name.
+		{"a;b.txt", "/letters/a;b.txt", "text/plain; charset=utf-8"},
+		{"c; d.txt", "/letters/c; d.txt", "text/plain"},
+	}, attachments)
+
+	message.Conf.Set(CONF_ATTACH, "; text/plain")
+	_, err = messageAttachments(message)
+	assert.NotNil(t, err)
+}
+
+func TestVerifyAttachments(t *testing.T) {
+	workdir := testWorkdir(t)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(workdir, DIR_TODO, "notes.txt"), []byte("Some notes."), 0666))
+
+	message := newTestMessage(map[string]string{
+		CONF_WORKDIR: workdir,
+		CONF_ATTACH:  "notes.txt",
+	})
+	assert.Nil(t, verifyAttachments(message))
+	assert.True(t, checkMessage(*message, true))
+
+	message.Conf.Set(CONF_ATTACH, "notes.txt\nmissing.pdf\n..")
+	errs := verifyAttachments(message)
+	require.Equal(t, 2, len(errs))
+	assert.Contains(t, errs[0].Error(), "missing.pdf")
+	assert.Contains(t, errs[1].Error(), "not a regular file")
+	assert.False(t, checkMessage(*message, true))
+}
+
+func TestPrepareEmail_Attachments(t *testing.T) {
+	workdir := testWorkdir(t)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(workdir, DIR_TODO, "notes.txt"), []byte("Some notes."), 0666))
+
+	envelope, err := prepareEnvelope(newTestMessage(map[string]string{
+		CONF_WORKDIR: workdir,
+		CONF_ATTACH:  "notes.txt; text/x-notes",
+	}))
+	require.Nil(t, err)
+
+	mediaType, _, parts := multipartParts(t, envelope.Data)
+	assert.Equal(t, "multipart/mixed", mediaType)
+	require.Equal(t, 2, len(parts))
+	assert.Contains(t, parts[0], "Hello.")
+	assert.Contains(t, parts[1], "Content-Type: text/x-notes")
+	assert.Contains(t, parts[1], `filename="notes.txt"`)
+
+	// The body of the attachment is base64 encoded.
+	assert.Contains(t, parts[1], "U29tZSBub3Rlcy4=")
+}
+
+func TestProcessMessage_CopyAttachments(t *testing.T) {
+	transport := useMemoryTransport(t)
+
+	outside, err := ioutil.TempFile("", "lettersnail")
+	require.Nil(t, err)
+	outside.Close()
+	defer os.Remove(outside.Name())
+
+	workdir := testWorkdir(t)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(workdir, DIR_TODO, "notes.txt"), []byte("Some notes."), 0666))
+
+	message := todoMessage(t, workdir, "1.msg", testConfiguration(workdir, "memory"),
+		"from: me@example.com",
+		"to: you@example.com",
+		"subject: Test",
+		"date: 2000-01-01",
+		"attach: notes.txt",
+		"attach: "+outside.Name(),
+		"",
+		"Hello.")
+
+	require.Nil(t, newRunner(time.Now(), false, false).processMessage(message))
+	require.Equal(t, 1, len(transport.envelopes))
+
+	// Attachments next to the message go along with it, others stay
+	// where they are.
+	assertExists(t, filepath.Join(workdir, DIR_DONE, "1.msg"))
+	assertExists(t, filepath.Join(workdir, DIR_DONE, "notes.txt"))
+	assertExists(t, filepath.Join(workdir, DIR_TODO, "notes.txt"))
+
+	done, err := NewMessageFromFile(filepath.Join(workdir, DIR_DONE, "1.msg"))
+	require.Nil(t, err)
+	assert.Equal(t, []string{"notes.txt", outside.Name()}, done.Conf.GetList(CONF_ATTACH))
+	assert.Nil(t, verifyAttachments(&done))
+}
+
+func TestRequeueMessage_CopyAttachments(t *testing.T) {
+	transport := useMemoryTransport(t)
+	workdir := testWorkdir(t)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(workdir, DIR_TODO, "notes.txt"), []byte("Some notes."), 0666))
+
+	conf := testConfiguration(workdir, "memory")
+
+	message := todoMessage(t, workdir, "1.msg", conf,
+		"from: me@example.com",
+		"to: you@example.com",
+		"subject: Test",
+		"date: 2000-01-01",
+		"attach: notes.txt",
+		"",
+		"Hello.")
+
+	transport.err = fmt.Errorf("no pigeons left")
+	require.Nil(t, newRunner(time.Now(), false, false).processMessage(message))
+	transport.err = nil
+
+	assertExists(t, filepath.Join(workdir, DIR_ERRORS, "1.msg"))
+	assertExists(t, filepath.Join(workdir, DIR_ERRORS, "notes.txt"))
+
+	// The original is gone by the time the message is retried.
+	require.Nil(t, os.Remove(filepath.Join(workdir, DIR_TODO, "notes.txt")))
+
+	message, err := requeueMessage("1.msg", conf, true)
+	require.Nil(t, err)
+	assertExists(t, filepath.Join(workdir, DIR_TODO, "notes.txt"))
+
+	require.Nil(t, newRunner(time.Now(), false, false).processMessage(message))
+	require.Equal(t, 1, len(transport.envelopes))
+	assert.Contains(t, string(transport.envelopes[0].Data), "U29tZSBub3Rlcy4=")
+	assertExists(t, filepath.Join(workdir, DIR_DONE, "notes.txt"))
+}
@@ -0,0 +1,231 @@
+/* auth.go: SMTP authentication
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"fmt"
+	. "github.com/githubert/lettersnail/common"
+	"net/smtp"
+	"strings"
+)
+
+// Supported values for CONF_SMTP_AUTH.
+const (
+	AUTH_AUTO     = "auto"
+	AUTH_NONE     = "none"
+	AUTH_PLAIN    = "plain"
+	AUTH_LOGIN    = "login"
+	AUTH_CRAM_MD5 = "cram-md5"
+
+	AUTH_XOAUTH2     = "xoauth2"
+	AUTH_OAUTHBEARER = "oauthbearer"
+)
+
+// smtpAuth is a smtp.Auth that picks the actual mechanism only once it knows
+// what the server advertises, and whether the connection is encrypted.
+type smtpAuth struct {
+	user          string
+	credentials   *credentials
+	oauth         *oauthSource
+	mechanism     string
+	allowInsecure bool
+
+	chosen smtp.Auth
+}
+
+// Build the smtp.Auth for the given message. If no user is configured, or
+// authentication was explicitly disabled, nil is returned.
+func newAuth(message *Message) (smtp.Auth, error) {
+	mechanism := strings.ToLower(message.Get(CONF_SMTP_AUTH))
+
+	if mechanism == "" {
+		mechanism = AUTH_AUTO
+	}
+
+	switch mechanism {
+	case AUTH_NONE:
+		return nil, nil
+	case AUTH_AUTO, AUTH_PLAIN, AUTH_LOGIN, AUTH_CRAM_MD5, AUTH_XOAUTH2, AUTH_OAUTHBEARER:
+	default:
+		return nil, fmt.Errorf("unknown authentication mechanism '%s'", mechanism)
+	}
+
+	if message.Get(CONF_SMTP_USER) == "" {
+		if mechanism != AUTH_AUTO {
+			return nil, fmt.Errorf("'%s' is set to '%s', but '%s' is missing", CONF_SMTP_AUTH, mechanism, CONF_SMTP_USER)
+		}
+
+		return nil, nil
+	}
+
+	allowInsecure, err := message.Conf.GetBool(CONF_SMTP_ALLOW_INSECURE_AUTH)
+
+	if err != nil {
+		return nil, err
+	}
+
+	auth := &smtpAuth{
+		user:          message.Get(CONF_SMTP_USER),
+		credentials:   newCredentials(message),
+		mechanism:     mechanism,
+		allowInsecure: allowInsecure,
+	}
+
+	if mechanism == AUTH_XOAUTH2 || mechanism == AUTH_OAUTHBEARER {
+		if auth.oauth, err = newOAuthSource(message); err != nil {
+			return nil, err
+		}
+	}
+
+	return auth, nil
+}
+
+// Like net/smtp, connections to the local host are considered safe.
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+func (a *smtpAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !a.allowInsecure && !isLocalhost(server.Name) {
+		return "", nil, fmt.Errorf("refusing to send credentials over an unencrypted connection to %s (set '%s' to override)", server.Name, CONF_SMTP_ALLOW_INSECURE_AUTH)
+	}
+
+	mechanism, err := a.choose(server)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	if a.oauth != nil {
+		token, err := a.oauth.AccessToken()
+
+		if err != nil {
+			return "", nil, err
+		}
+
+		if mechanism == AUTH_XOAUTH2 {
+			a.chosen = &xoauth2Auth{a.user, token}
+		} else {
+			a.chosen = &oauthBearerAuth{a.user, token}
+		}
+
+		return a.chosen.Start(server)
+	}
+
+	// Only now the password is really needed. The name is the host of the
+	// server actually dialed, which may be a fallback.
+	password, err := a.credentials.Password(server.Name)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch mechanism {
+	case AUTH_PLAIN:
+		a.chosen = &plainAuth{a.user, password}
+	case AUTH_LOGIN:
+		a.chosen = &loginAuth{a.user, password}
+	case AUTH_CRAM_MD5:
+		a.chosen = smtp.CRAMMD5Auth(a.user, password)
+	}
+
+	return a.chosen.Start(server)
+}
+
+func (a *smtpAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	return a.chosen.Next(fromServer, more)
+}
+
+// Pick the mechanism to use. An explicitly configured mechanism must be
+// advertised by the server. Otherwise CRAM-MD5 is preferred on unencrypted
+// connections, as it does not reveal the password.
+func (a *smtpAuth) choose(server *smtp.ServerInfo) (string, error) {
+	advertised := map[string]bool{}
+
+	for _, m := range server.Auth {
+		advertised[strings.ToLower(m)] = true
+	}
+
+	if a.mechanism != AUTH_AUTO {
+		if !advertised[a.mechanism] {
+			return "", fmt.Errorf("server does not support authentication mechanism '%s' (offered: %s)", a.mechanism, strings.Join(server.Auth, " "))
+		}
+
+		return a.mechanism, nil
+	}
+
+	preference := []string{AUTH_PLAIN, AUTH_LOGIN, AUTH_CRAM_MD5}
+
+	if !server.TLS {
+		preference = []string{AUTH_CRAM_MD5, AUTH_PLAIN, AUTH_LOGIN}
+	}
+
+	for _, m := range preference {
+		if advertised[m] {
+			return m, nil
+		}
+	}
+
+	return "", fmt.Errorf("no supported authentication mechanism offered by server (offered: %s)", strings.Join(server.Auth, " "))
+}
+
+// PLAIN as in RFC 4616. Unlike smtp.PlainAuth this does not check for TLS
+// itself, smtpAuth takes care of that.
+type plainAuth struct {
+	user     string
+	password string
+}
+
+func (a *plainAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "PLAIN", []byte("\x00" + a.user + "\x00" + a.password), nil
+}
+
+func (a *plainAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return nil, fmt.Errorf("unexpected server challenge")
+	}
+
+	return nil, nil
+}
+
+// The non-standard, but widely used LOGIN mechanism.
+type loginAuth struct {
+	user     string
+	password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	prompt := strings.ToLower(strings.TrimSpace(string(fromServer)))
+
+	switch {
+	case strings.HasPrefix(prompt, "username"):
+		return []byte(a.user), nil
+	case strings.HasPrefix(prompt, "password"):
+		return []byte(a.password), nil
+	}
+
+	return nil, fmt.Errorf("unexpected server challenge: %s", fromServer)
+}
@@ -0,0 +1,90 @@
+/* auth_test.go: unit tests for SMTP authentication
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	. "github.com/githubert/lettersnail/common"
+	"github.com/stretchr/testify/assert"
+	"net/smtp"
+	"testing"
+)
+
+func TestNewAuth(t *testing.T) {
+	// No user, no authentication.
+	auth, err := newAuth(newTestMessage(nil))
+	assert.Nil(t, err)
+	assert.Nil(t, auth)
+
+	// Explicitly disabled.
+	auth, err = newAuth(newTestMessage(map[string]string{CONF_SMTP_USER: "me", CONF_SMTP_AUTH: "none"}))
+	assert.Nil(t, err)
+	assert.Nil(t, auth)
+
+	// A mechanism without a user is a mistake.
+	_, err = newAuth(newTestMessage(map[string]string{CONF_SMTP_AUTH: "plain"}))
+	assert.NotNil(t, err)
+
+	_, err = newAuth(newTestMessage(map[string]string{CONF_SMTP_USER: "me", CONF_SMTP_AUTH: "foo"}))
+	assert.NotNil(t, err)
+}
+
+func TestSmtpAuth_Start(t *testing.T) {
+	auth, _ := newAuth(newTestMessage(map[string]string{CONF_SMTP_USER: "me", CONF_SMTP_PASSWORD: "secret"}))
+
+	// Refuse unencrypted connections.
+	_, _, err := auth.Start(&smtp.ServerInfo{Name: "mail.example.com", TLS: false, Auth: []string{"PLAIN"}})
+	assert.NotNil(t, err)
+
+	mech, resp, err := auth.Start(&smtp.ServerInfo{Name: "mail.example.com", TLS: true, Auth: []string{"LOGIN", "PLAIN"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "PLAIN", mech)
+	assert.Equal(t, "\x00me\x00secret", string(resp))
+
+	mech, _, err = auth.Start(&smtp.ServerInfo{Name: "mail.example.com", TLS: true, Auth: []string{"LOGIN"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "LOGIN", mech)
+
+	resp, _ = auth.Next([]byte("Password:"), true)
+	assert.Equal(t, "secret", string(resp))
+
+	// Nothing in common.
+	_, _, err = auth.Start(&smtp.ServerInfo{Name: "mail.example.com", TLS: true, Auth: []string{"GSSAPI"}})
+	assert.NotNil(t, err)
+}
+
+func TestSmtpAuth_StartInsecure(t *testing.T) {
+	auth, _ := newAuth(newTestMessage(map[string]string{
+		CONF_SMTP_USER:                "me",
+		CONF_SMTP_PASSWORD:            "secret",
+		CONF_SMTP_ALLOW_INSECURE_AUTH: "true",
+	}))
+
+	// CRAM-MD5 is preferred, if the connection is not encrypted.
+	mech, _, err := auth.Start(&smtp.ServerInfo{Name: "mail.example.com", TLS: false, Auth: []string{"PLAIN", "CRAM-MD5"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "CRAM-MD5", mech)
+
+	// An explicit mechanism has to be offered by the server.
+	auth, _ = newAuth(newTestMessage(map[string]string{
+		CONF_SMTP_USER: "me",
+		CONF_SMTP_AUTH: "cram-md5",
+	}))
+
+	_, _, err = auth.Start(&smtp.ServerInfo{Name: "localhost", TLS: false, Auth: []string{"PLAIN"}})
+	assert.NotNil(t, err)
+}
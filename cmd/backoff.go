@@ -0,0 +1,325 @@
+/* backoff.go: retry temporary delivery failures later on
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	. "github.com/githubert/lettersnail/common"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	DEFAULT_RETRY_LIMIT = 5
+	DEFAULT_RETRY_DELAY = 5 * time.Minute
+
+	// No matter how many attempts were made, wait at most this long.
+	MAX_RETRY_DELAY = 24 * time.Hour
+)
+
+// Keys of the retry state file.
+const (
+	RETRY_ATTEMPTS     = "attempts"
+	RETRY_NEXT_ATTEMPT = "next-attempt"
+	RETRY_LAST_ERROR   = "last-error"
+	RETRY_ACCEPTED     = "accepted"
+	RETRY_REJECTED     = "rejected"
+)
+
+// A failure that may go away if we try again later, like a full mailbox or a
+// server that is down for maintenance.
+type temporaryError struct {
+	error
+}
+
+// Mark the given error as temporary.
+func temporary(err error) error {
+	return temporaryError{err}
+}
+
+// Let errors.As find what made the failure temporary, like an SMTP reply.
+func (e temporaryError) Unwrap() error {
+	return e.error
+}
+
+// Network errors that usually do not last.
+var temporaryErrnos = []syscall.Errno{
+	syscall.ECONNREFUSED,
+	syscall.ECONNRESET,
+	syscall.ECONNABORTED,
+	syscall.EHOSTUNREACH,
+	syscall.ENETUNREACH,
+	syscall.EPIPE,
+}
+
+// Decide whether a failed delivery is worth another try. SMTP replies in the
+// 4xx range, timeouts and a server that cannot be reached count as temporary,
+// everything else as permanent.
+func isTemporary(err error) bool {
+	var tmp temporaryError
+
+	if errors.As(err, &tmp) {
+		return true
+	}
+
+	var reply *textproto.Error
+
+	if errors.As(err, &reply) {
+		return reply.Code >= 400 && reply.Code < 500
+	}
+
+	var dnsErr *net.DNSError
+
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary || dnsErr.IsTimeout
+	}
+
+	var netErr net.Error
+
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	// The server hung up on us.
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	for _, errno := range temporaryErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// How often and how long to wait before trying again, as configured for the
+// given message.
+func retryPolicy(message *Message) (int, time.Duration, error) {
+	limit, delay := DEFAULT_RETRY_LIMIT, DEFAULT_RETRY_DELAY
+
+	if message.Get(CONF_RETRY_LIMIT) != "" {
+		var err error
+
+		if limit, err = message.Conf.GetInt(CONF_RETRY_LIMIT); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if message.Get(CONF_RETRY_DELAY) != "" {
+		var err error
+
+		if delay, err = message.Conf.GetDuration(CONF_RETRY_DELAY); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return limit, delay, nil
+}
+
+// The time to wait after the given number of failed attempts: `delay` after
+// the first one, doubling with each further attempt.
+func backoff(delay time.Duration, attempts int) time.Duration {
+	for i := 1; i < attempts && delay < MAX_RETRY_DELAY; i++ {
+		delay *= 2
+	}
+
+	if delay > MAX_RETRY_DELAY {
+		return MAX_RETRY_DELAY
+	}
+
+	return delay
+}
+
+// Bookkeeping for a message whose delivery failed temporarily. It is stored
+// next to the message in todo/, as NAME.retry.
+type retryState struct {
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+
+	// Recipients that were accepted, or rejected for good, by earlier
+	// attempts. They are left out of the next one.
+	Accepted []string
+	Rejected []string
+}
+
+// The recipients that need not be tried again.
+func (s *retryState) done() []string {
+	return append(append([]string{}, s.Accepted...), s.Rejected...)
+}
+
+func retryStatePath(message *Message) string {
+	return retryStatePathIn(message, DIR_TODO)
+}
+
+func retryStatePathIn(message *Message, dir string) string {
+	name := strings.TrimSuffix(message.Name, ".msg") + ".retry"
+
+	return filepath.Join(message.Get(CONF_WORKDIR), dir, name)
+}
+
+// Load the retry state of the given message. A message that has not failed
+// yet has an empty state.
+func loadRetryState(message *Message) (*retryState, error) {
+	state := &retryState{}
+
+	f, err := os.Open(retryStatePath(message))
+
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	conf := NewConfiguration()
+	conf.Load(lines)
+
+	if state.Attempts, err = conf.GetInt(RETRY_ATTEMPTS); err != nil {
+		return nil, err
+	}
+
+	if next := conf.Get(RETRY_NEXT_ATTEMPT); next != "" {
+		if state.NextAttempt, err = time.Parse(time.RFC3339, next); err != nil {
+			return nil, err
+		}
+	}
+
+	state.LastError = conf.Get(RETRY_LAST_ERROR)
+	state.Accepted = splitList(conf.Get(RETRY_ACCEPTED))
+	state.Rejected = splitList(conf.Get(RETRY_REJECTED))
+
+	return state, nil
+}
+
+// Split a comma-separated list, leaving out empty items.
+func splitList(list string) []string {
+	items := []string{}
+
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// Store the retry state of the given message.
+func (s *retryState) save(message *Message) error {
+	return s.saveAs(retryStatePath(message))
+}
+
+func (s *retryState) saveAs(path string) error {
+	conf := NewConfiguration()
+	conf.Set(RETRY_ATTEMPTS, strconv.Itoa(s.Attempts))
+	conf.Set(RETRY_NEXT_ATTEMPT, s.NextAttempt.Format(time.RFC3339))
+	conf.Set(RETRY_LAST_ERROR, strings.Join(strings.Fields(s.LastError), " "))
+
+	if len(s.Accepted) > 0 {
+		conf.Set(RETRY_ACCEPTED, strings.Join(s.Accepted, ", "))
+	}
+
+	if len(s.Rejected) > 0 {
+		conf.Set(RETRY_REJECTED, strings.Join(s.Rejected, ", "))
+	}
+
+	content := strings.Join(conf.DumpConfig(), "\n") + "\n"
+
+	return writeFileAtomic(path, []byte(content))
+}
+
+// Forget about earlier attempts, once the message leaves todo/.
+func removeRetryState(message *Message) error {
+	err := os.Remove(retryStatePath(message))
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// Forget about earlier attempts when the message is moved to errors/, except
+// for the recipients that accepted it. They are kept in errors/, so that they
+// do not get the message again once it is requeued.
+func keepAccepted(message *Message, state *retryState) error {
+	if err := removeRetryState(message); err != nil {
+		return err
+	}
+
+	if len(state.Accepted) == 0 {
+		return nil
+	}
+
+	kept := &retryState{Accepted: state.Accepted}
+
+	return kept.saveAs(retryStatePathIn(message, DIR_ERRORS))
+}
+
+// Write a file through a temporary file, so that it is either complete or not
+// there at all.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return err
+}
@@ -0,0 +1,154 @@
+/* backoff_test.go: unit tests for retrying temporary failures
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"fmt"
+	. "github.com/githubert/lettersnail/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsTemporary(t *testing.T) {
+	tests := []struct {
+		err       error
+		temporary bool
+	}{
+		{&textproto.Error{Code: 451, Msg: "greylisted"}, true},
+		{&textproto.Error{Code: 550, Msg: "no such user"}, false},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, true},
+		{&net.DNSError{Err: "no such host", IsNotFound: true}, false},
+		{&net.DNSError{Err: "timeout", IsTimeout: true}, true},
+		{io.EOF, true},
+		{temporary(fmt.Errorf("try later")), true},
+		{fmt.Errorf("certificate signed by unknown authority"), false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.temporary, isTemporary(test.err), test.err.Error())
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, 5*time.Minute, backoff(5*time.Minute, 1))
+	assert.Equal(t, 10*time.Minute, backoff(5*time.Minute, 2))
+	assert.Equal(t, 40*time.Minute, backoff(5*time.Minute, 4))
+	assert.Equal(t, MAX_RETRY_DELAY, backoff(5*time.Minute, 100))
+	assert.Equal(t, MAX_RETRY_DELAY, backoff(48*time.Hour, 1))
+}
+
+func TestRetryPolicy(t *testing.T) {
+	message := newTestMessage(nil)
+
+	limit, delay, err := retryPolicy(message)
+	assert.Nil(t, err)
+	assert.Equal(t, DEFAULT_RETRY_LIMIT, limit)
+	assert.Equal(t, DEFAULT_RETRY_DELAY, delay)
+
+	message.Conf.Set(CONF_RETRY_LIMIT, "0")
+	message.Conf.Set(CONF_RETRY_DELAY, "1h")
+
+	limit, delay, err = retryPolicy(message)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, limit)
+	assert.Equal(t, time.Hour, delay)
+}
+
+func TestProcessMessage_Retry(t *testing.T) {
+	transport := useMemoryTransport(t)
+	transport.err = &textproto.Error{Code: 451, Msg: "greylisted"}
+
+	workdir := testWorkdir(t)
+
+	conf := testConfiguration(workdir, "memory")
+	conf.Set(CONF_RETRY_LIMIT, "2")
+	conf.Set(CONF_RETRY_DELAY, "10m")
+
+	message := todoMessage(t, workdir, "1.msg", conf)
+
+	now := time.Now()
+
+	// The first failure keeps the message in todo/.
+	require.Nil(t, newRunner(now, false, false).processMessage(message))
+	assertExists(t, filepath.Join(workdir, DIR_TODO, "1.msg"))
+
+	state, err := loadRetryState(&message)
+	require.Nil(t, err)
+	assert.Equal(t, 1, state.Attempts)
+	assert.Equal(t, now.Add(10*time.Minute).Unix(), state.NextAttempt.Unix())
+
+	// Too early for the next attempt, the message is not touched.
+	require.Nil(t, newRunner(now.Add(5*time.Minute), false, false).processMessage(message))
+
+	// The second attempt doubles the delay.
+	now = now.Add(11 * time.Minute)
+	require.Nil(t, newRunner(now, false, false).processMessage(message))
+
+	state, err = loadRetryState(&message)
+	require.Nil(t, err)
+	assert.Equal(t, 2, state.Attempts)
+	assert.Equal(t, now.Add(20*time.Minute).Unix(), state.NextAttempt.Unix())
+
+	// The limit is reached, so the message fails for good.
+	require.Nil(t, newRunner(now.Add(time.Hour), false, false).processMessage(message))
+	assertExists(t, filepath.Join(workdir, DIR_ERRORS, "1.msg"))
+
+	_, err = os.Stat(retryStatePath(&message))
+	assert.True(t, os.IsNotExist(err))
+
+	log, err := ioutil.ReadFile(filepath.Join(workdir, DIR_ERRORS, "1.log"))
+	require.Nil(t, err)
+	assert.Contains(t, string(log), "Giving up after 3 attempts. 451")
+}
+
+func TestProcessMessage_RetrySucceeds(t *testing.T) {
+	transport := useMemoryTransport(t)
+	transport.err = temporary(fmt.Errorf("try later"))
+
+	workdir := testWorkdir(t)
+	conf := testConfiguration(workdir, "memory")
+	message := todoMessage(t, workdir, "1.msg", conf)
+
+	now := time.Now()
+
+	require.Nil(t, newRunner(now, false, false).processMessage(message))
+	assertExists(t, retryStatePath(&message))
+
+	transport.err = nil
+
+	require.Nil(t, newRunner(now.Add(DEFAULT_RETRY_DELAY), false, false).processMessage(message))
+	assertExists(t, filepath.Join(workdir, DIR_DONE, "1.msg"))
+
+	_, err := os.Stat(retryStatePath(&message))
+	assert.True(t, os.IsNotExist(err))
+
+	// Permanent failures are not retried at all.
+	transport.err = &textproto.Error{Code: 550, Msg: "no such user"}
+
+	require.Nil(t, newRunner(now, false, false).processMessage(todoMessage(t, workdir, "2.msg", conf)))
+	assertExists(t, filepath.Join(workdir, DIR_ERRORS, "2.msg"))
+}
@@ -55,7 +55,7 @@ func Check(argv []string, conf *Configuration) {
 			os.Exit(1)
 		}
 
-		message.Conf.MergeWith(conf)
+		message.MergeWith(conf)
 		ok = checkMessage(message, silent)
 	} else {
 		draftOk := checkFolder(DIR_DRAFTS, conf, silent)
@@ -91,7 +91,7 @@ func checkFolder(folder string, conf *Configuration, silent bool) bool {
 
 	for _, message := range messages {
 		count++
-		message.Conf.MergeWith(conf)
+		message.MergeWith(conf)
 
 		if !checkMessage(message, silent) {
 			ok = false
@@ -109,7 +109,7 @@ func checkFolder(folder string, conf *Configuration, silent bool) bool {
 // to stdout.
 func checkMessage(message Message, silent bool) bool {
 	ok := true
-	errs := message.Verify()
+	errs := messageProblems(&message)
 
 	if errs != nil {
 		ok = false
@@ -129,3 +129,30 @@ func checkMessage(message Message, silent bool) bool {
 
 	return ok
 }
+
+// Return all problems of the given message, or nil if there are none.
+func messageProblems(message *Message) []error {
+	errs := message.Verify()
+
+	if err := verifyDKIM(message); err != nil {
+		errs = append(errs, err)
+	}
+
+	errs = append(errs, verifyPGP(message)...)
+	errs = append(errs, verifySMIME(message)...)
+	errs = append(errs, verifyAttachments(message)...)
+
+	if err := verifyWebhook(message); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := bodyFormat(message); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := partialFailurePolicy(message); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
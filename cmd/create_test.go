@@ -18,12 +18,8 @@
 package cmd
 
 import (
-	"fmt"
 	"github.com/stretchr/testify/assert"
-	"github.com/stretchr/testify/require"
-	"io/ioutil"
 	"os"
-	"path/filepath"
 	"testing"
 )
 
@@ -0,0 +1,239 @@
+/* credentials.go: look up passwords in a command or a netrc file
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	. "github.com/githubert/lettersnail/common"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Where the password for SMTP authentication comes from: the `password`
+// setting, the output of `password-command`, or the netrc file. The password
+// is only looked up once it is needed, and kept for later sessions.
+type credentials struct {
+	user     string
+	password string
+	command  string
+	netrc    string
+
+	resolved bool
+
+	// Passwords found in the netrc file, by machine.
+	machines map[string]string
+}
+
+func newCredentials(message *Message) *credentials {
+	return &credentials{
+		user:     message.Get(CONF_SMTP_USER),
+		password: message.Get(CONF_SMTP_PASSWORD),
+		command:  message.Get(CONF_SMTP_PASSWORD_COMMAND),
+		netrc:    message.Get(CONF_NETRC),
+		machines: map[string]string{},
+	}
+}
+
+// Return the password for the server `machine`, looking it up on first use.
+// Only the netrc file has a password for each server.
+func (c *credentials) Password(machine string) (string, error) {
+	if c.resolved {
+		return c.password, nil
+	}
+
+	if password, ok := c.machines[machine]; ok {
+		return password, nil
+	}
+
+	var err error
+
+	switch {
+	case c.password != "":
+	case c.command != "":
+		c.password, err = passwordFromCommand(c.command)
+	default:
+		password, err := c.passwordFromNetrc(machine)
+
+		if err != nil {
+			return "", err
+		}
+
+		c.machines[machine] = password
+
+		return password, nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	c.resolved = true
+
+	return c.password, nil
+}
+
+// Run the command through the shell, and take the first line of its output.
+// The command may ask for a passphrase, so it gets the terminal.
+func passwordFromCommand(command string) (string, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+
+	if err != nil {
+		return "", fmt.Errorf("'%s' failed: %s", CONF_SMTP_PASSWORD_COMMAND, err.Error())
+	}
+
+	password := strings.TrimRight(strings.SplitN(string(out), "\n", 2)[0], "\r")
+
+	if password == "" {
+		return "", fmt.Errorf("'%s' returned no password", CONF_SMTP_PASSWORD_COMMAND)
+	}
+
+	return password, nil
+}
+
+func (c *credentials) passwordFromNetrc(machine string) (string, error) {
+	file := c.netrc
+
+	if file == "" {
+		home, err := os.UserHomeDir()
+
+		if err != nil {
+			return "", fmt.Errorf("no password for %s", c.user)
+		}
+
+		file = filepath.Join(home, ".netrc")
+	}
+
+	data, err := ioutil.ReadFile(file)
+
+	// Only complain about a missing netrc file, if it was asked for.
+	if os.IsNotExist(err) && c.netrc == "" {
+		return "", fmt.Errorf("no password for %s, set '%s' or '%s'", c.user, CONF_SMTP_PASSWORD, CONF_SMTP_PASSWORD_COMMAND)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if password, ok := lookupNetrc(data, machine, c.user); ok {
+		return password, nil
+	}
+
+	return "", fmt.Errorf("no password for %s at %s in %s", c.user, machine, file)
+}
+
+// An entry of a netrc file. The `default` entry has no machine.
+type netrcEntry struct {
+	machine  string
+	login    string
+	password string
+}
+
+// Parse a netrc file, as used by ftp and curl. Macro definitions are skipped.
+func parseNetrc(data []byte) []netrcEntry {
+	entries := []netrcEntry{}
+	tokens := []string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	macro := false
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// A macro definition ends with an empty line.
+		if macro {
+			macro = strings.TrimSpace(line) != ""
+			continue
+		}
+
+		fields := strings.Fields(line)
+
+		if len(fields) > 0 && strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		for i, field := range fields {
+			if field == "macdef" {
+				fields = fields[:i]
+				macro = true
+				break
+			}
+		}
+
+		tokens = append(tokens, fields...)
+	}
+
+	for i := 0; i < len(tokens); i++ {
+		switch tokens[i] {
+		case "machine":
+			if i+1 < len(tokens) {
+				i++
+				entries = append(entries, netrcEntry{machine: tokens[i]})
+			}
+		case "default":
+			entries = append(entries, netrcEntry{})
+		case "login", "password", "account":
+			if i+1 >= len(tokens) || len(entries) == 0 {
+				continue
+			}
+
+			i++
+			entry := &entries[len(entries)-1]
+
+			if tokens[i-1] == "login" {
+				entry.login = tokens[i]
+			} else if tokens[i-1] == "password" {
+				entry.password = tokens[i]
+			}
+		}
+	}
+
+	return entries
+}
+
+// Find the password for `login` at `machine`. Entries without a login match
+// any user. If there is no entry for the machine, the default entry is used.
+func lookupNetrc(data []byte, machine string, login string) (string, bool) {
+	entries := parseNetrc(data)
+
+	for _, wanted := range []string{machine, ""} {
+		for _, entry := range entries {
+			if !strings.EqualFold(entry.machine, wanted) {
+				continue
+			}
+
+			if entry.login != "" && entry.login != login {
+				continue
+			}
+
+			if entry.password != "" {
+				return entry.password, true
+			}
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,120 @@
+/* credentials_test.go: tests for password lookup
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	. "github.com/githubert/lettersnail/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/smtp"
+	"path/filepath"
+	"testing"
+)
+
+var testNetrc = []byte(`# mail accounts
+machine mail.example.com login me password first
+machine mail.example.com
+	login other password second
+
+macdef init
+machine evil.example.com login me password macro
+
+machine other.example.com password third
+default login me password fallback
+`)
+
+func TestLookupNetrc(t *testing.T) {
+	for _, c := range []struct{ machine, login, password string }{
+		{"mail.example.com", "me", "first"},
+		{"MAIL.example.com", "other", "second"},
+		// No login means any user.
+		{"other.example.com", "you", "third"},
+		// Macros are not entries.
+		{"evil.example.com", "me", "fallback"},
+		{"mail.example.com", "you", ""},
+	} {
+		password, ok := lookupNetrc(testNetrc, c.machine, c.login)
+		assert.Equal(t, c.password != "", ok, c.machine)
+		assert.Equal(t, c.password, password, c.machine)
+	}
+}
+
+func TestCredentials_Password(t *testing.T) {
+	netrc := filepath.Join(testWorkdir(t), "netrc")
+	require.Nil(t, ioutil.WriteFile(netrc, testNetrc, 0600))
+
+	message := newTestMessage(map[string]string{
+		CONF_SMTP_USER: "me",
+		CONF_NETRC:     netrc,
+	})
+
+	credentials := newCredentials(message)
+
+	password, err := credentials.Password("mail.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "first", password)
+
+	// Each server has its own entry, like a fallback after a failover.
+	password, err = credentials.Password("evil.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "fallback", password)
+
+	password, err = credentials.Password("mail.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "first", password)
+
+	// The command wins over netrc, and only its first line counts.
+	message.Conf.Set(CONF_SMTP_PASSWORD_COMMAND, "printf 'from-command\\nsecond line\\n'")
+
+	password, err = newCredentials(message).Password("mail.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "from-command", password)
+
+	// A password in the configuration wins over everything.
+	message.Conf.Set(CONF_SMTP_PASSWORD, "plain")
+
+	password, err = newCredentials(message).Password("mail.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "plain", password)
+
+	message.Conf.Set(CONF_SMTP_PASSWORD, "")
+	message.Conf.Set(CONF_SMTP_PASSWORD_COMMAND, "exit 1")
+
+	_, err = newCredentials(message).Password("mail.example.com")
+	assert.NotNil(t, err)
+}
+
+func TestSmtpAuth_LazyPassword(t *testing.T) {
+	marker := filepath.Join(testWorkdir(t), "called")
+
+	auth, err := newAuth(newTestMessage(map[string]string{
+		CONF_SMTP_USER:             "me",
+		CONF_SMTP_PASSWORD_COMMAND: "touch " + marker + " && echo secret",
+	}))
+	require.Nil(t, err)
+
+	_, err = ioutil.ReadFile(marker)
+	assert.NotNil(t, err, "the command ran before the password was needed")
+
+	_, resp, err := auth.Start(&smtp.ServerInfo{Name: "mail.example.com", TLS: true, Auth: []string{"PLAIN"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "\x00me\x00secret", string(resp))
+
+	assertExists(t, marker)
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/docopt/docopt.go"
 	. "github.com/githubert/lettersnail/common"
 	"os"
+	"strings"
 )
 
 var usageDebug =
@@ -47,27 +48,56 @@ func Debug(argv []string, conf *Configuration) {
 
 	fmt.Println("Configuration\n-------------")
 
-	message.Conf.MergeWith(conf)
+	message.MergeWith(conf)
 
-	for _, line := range message.Conf.DumpConfig() {
-		fmt.Println(line)
+	if account := message.Get(CONF_ACCOUNT); account != "" {
+		fmt.Printf("Using account '%s'.\n\n", account)
 	}
 
-	// TODO: Verify Message?
-	e, err := prepareEmail(&message)
+	for _, key := range message.Conf.Keys() {
+		source := message.Conf.Source(key)
+
+		if source == "" {
+			source = "default"
+		}
+
+		// Keys given more than once, like attach:, get a line each.
+		for _, value := range strings.Split(message.Conf.Redacted(key), "\n") {
+			fmt.Printf("%-40s (%s)\n", fmt.Sprintf("%s: %s", key, value), source)
+		}
+	}
+
+	if errs := message.Verify(); errs != nil {
+		fmt.Println("\nProblems\n--------")
+
+		for _, err := range errs {
+			fmt.Println(err.Error())
+		}
+	}
+
+	envelope, err := prepareEnvelope(&message)
 
 	if err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
 	}
 
-	m, err := e.Bytes()
+	fmt.Println("\nTransport\n---------")
 
-	if err != nil {
+	if transport, err := newTransport(&message); err != nil {
 		fmt.Println(err.Error())
-		os.Exit(1)
+	} else {
+		fmt.Println(transport)
+	}
+
+	fmt.Println("\nMIME structure\n--------------")
+
+	if tree, err := mimeTree(envelope.Data); err != nil {
+		fmt.Println(err.Error())
+	} else {
+		fmt.Println(strings.Join(tree, "\n"))
 	}
 
 	fmt.Println("\nEmail message\n-------------")
-	fmt.Println(string(m))
+	fmt.Println(string(envelope.Data))
 }
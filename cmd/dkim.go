@@ -0,0 +1,256 @@
+/* dkim.go: DKIM signatures for outgoing messages
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	. "github.com/githubert/lettersnail/common"
+	"io/ioutil"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Supported signature algorithms.
+const (
+	DKIM_RSA_SHA256     = "rsa-sha256"
+	DKIM_ED25519_SHA256 = "ed25519-sha256"
+)
+
+// Header fields that are signed, if the message has them.
+var dkimHeaders = []string{
+	"From",
+	"Reply-To",
+	"Subject",
+	"Date",
+	"To",
+	"Cc",
+	"Message-Id",
+	"Mime-Version",
+	"Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// Signs messages with DKIM (RFC 6376), using relaxed canonicalization for
+// header and body.
+type dkimSigner struct {
+	domain    string
+	selector  string
+	algorithm string
+	key       crypto.Signer
+}
+
+// Create the signer configured for the given message. If the message is not
+// to be signed at all, nil is returned.
+func newDKIMSigner(message *Message) (*dkimSigner, error) {
+	domain := message.Get(CONF_DKIM_DOMAIN)
+	selector := message.Get(CONF_DKIM_SELECTOR)
+	file := message.Get(CONF_DKIM_KEY)
+
+	if domain == "" && selector == "" && file == "" {
+		return nil, nil
+	}
+
+	for _, key := range []string{CONF_DKIM_DOMAIN, CONF_DKIM_SELECTOR, CONF_DKIM_KEY} {
+		if message.Get(key) == "" {
+			return nil, fmt.Errorf("'%s' parameter is missing", key)
+		}
+	}
+
+	key, err := loadDKIMKey(file)
+
+	if err != nil {
+		return nil, fmt.Errorf("reading '%s': %s", CONF_DKIM_KEY, err.Error())
+	}
+
+	signer := &dkimSigner{domain: strings.ToLower(domain), selector: selector, key: key}
+
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		signer.algorithm = DKIM_RSA_SHA256
+	case ed25519.PrivateKey:
+		signer.algorithm = DKIM_ED25519_SHA256
+	}
+
+	return signer, nil
+}
+
+// Load an RSA or Ed25519 private key from a PEM file.
+func loadDKIMKey(file string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+
+	if block == nil {
+		return nil, fmt.Errorf("%s contains no PEM data", file)
+	}
+
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("%s contains neither an RSA nor an Ed25519 key", file)
+}
+
+// Check the DKIM settings of the given message: the key has to load, and the
+// domain has to match the sender's, as receivers will otherwise not consider
+// the signature to be the sender's.
+func verifyDKIM(message *Message) error {
+	signer, err := newDKIMSigner(message)
+
+	if err != nil || signer == nil {
+		return err
+	}
+
+	from, err := mail.ParseAddress(message.Get(CONF_FROM))
+
+	if err != nil {
+		return err
+	}
+
+	domain := strings.ToLower(from.Address[strings.LastIndex(from.Address, "@")+1:])
+
+	if domain != signer.domain && !strings.HasSuffix(domain, "."+signer.domain) {
+		return fmt.Errorf("'%s' %s does not match the sender's domain %s", CONF_DKIM_DOMAIN, signer.domain, domain)
+	}
+
+	return nil
+}
+
+// Return the message with a DKIM-Signature header added in front.
+func (s *dkimSigner) Sign(data []byte, now time.Time) ([]byte, error) {
+	header, body := splitHeader(data)
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+
+	fields := headerFields(header)
+	signed := []string{}
+
+	var hashed bytes.Buffer
+
+	for _, name := range dkimHeaders {
+		if field, ok := fields[strings.ToLower(name)]; ok {
+			signed = append(signed, name)
+			hashed.WriteString(relaxedHeader(field))
+		}
+	}
+
+	signature := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n"+
+		"\tt=%d; h=%s;\r\n"+
+		"\tbh=%s;\r\n"+
+		"\tb=",
+		s.algorithm, s.domain, s.selector,
+		now.Unix(), strings.Join(signed, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+
+	// The signature header itself is hashed with an empty b= tag, and
+	// without the final line break.
+	hashed.WriteString(strings.TrimSuffix(relaxedHeader(signature), "\r\n"))
+
+	digest := sha256.Sum256(hashed.Bytes())
+
+	var b []byte
+	var err error
+
+	if s.algorithm == DKIM_ED25519_SHA256 {
+		b, err = s.key.Sign(rand.Reader, digest[:], crypto.Hash(0))
+	} else {
+		b, err = s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(signature+foldBase64(base64.StdEncoding.EncodeToString(b))+"\r\n"), data...), nil
+}
+
+// Split the value of the b= tag into several lines. Whitespace in it is
+// ignored by verifiers.
+func foldBase64(value string) string {
+	parts := []string{}
+
+	for len(value) > 72 {
+		parts = append(parts, value[:72])
+		value = value[72:]
+	}
+
+	return strings.Join(append(parts, value), "\r\n\t")
+}
+
+var whitespace = regexp.MustCompile(`[ \t]+`)
+
+// Canonicalize a header field with the "relaxed" algorithm of RFC 6376,
+// section 3.4.2.
+func relaxedHeader(field string) string {
+	colon := strings.Index(field, ":")
+
+	name := strings.ToLower(strings.TrimSpace(field[:colon]))
+
+	value := strings.Replace(field[colon+1:], "\r\n", "", -1)
+	value = whitespace.ReplaceAllString(value, " ")
+	value = strings.TrimSpace(value)
+
+	return name + ":" + value + "\r\n"
+}
+
+// Canonicalize a body with the "relaxed" algorithm of RFC 6376, section 3.4.4.
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(whitespace.ReplaceAllString(line, " "), " ")
+	}
+
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(lines) == 0 {
+		return []byte{}
+	}
+
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
@@ -0,0 +1,166 @@
+/* dkim_test.go: unit tests for DKIM signatures
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	. "github.com/githubert/lettersnail/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Write the given private key as PEM file into `dir`.
+func writeDKIMKey(t *testing.T, dir string, key crypto.Signer) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.Nil(t, err)
+
+	file := filepath.Join(dir, "dkim.pem")
+	require.Nil(t, ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+
+	return file
+}
+
+// Verify the DKIM signature of a message, the way a receiver would.
+func verifyDKIMSignature(t *testing.T, data []byte, public crypto.PublicKey) {
+	header, body := splitHeader(data)
+	fields := headerFields(header)
+
+	signature, ok := fields["dkim-signature"]
+	require.True(t, ok)
+
+	tags := map[string]string{}
+
+	for _, tag := range strings.Split(relaxedHeader(signature)[len("dkim-signature:"):], ";") {
+		kv := strings.SplitN(strings.TrimSpace(tag), "=", 2)
+		tags[kv[0]] = strings.Replace(kv[1], " ", "", -1)
+	}
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	assert.Equal(t, base64.StdEncoding.EncodeToString(bodyHash[:]), tags["bh"])
+
+	hashed := ""
+
+	for _, name := range strings.Split(tags["h"], ":") {
+		hashed += relaxedHeader(fields[strings.ToLower(name)])
+	}
+
+	// The signature header, with the b= tag emptied.
+	empty := signature[:strings.Index(signature, "b=")+2]
+	hashed += strings.TrimSuffix(relaxedHeader(empty+"\r\n"), "\r\n")
+
+	digest := sha256.Sum256([]byte(hashed))
+	b, err := base64.StdEncoding.DecodeString(tags["b"])
+	require.Nil(t, err)
+
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		assert.Equal(t, DKIM_RSA_SHA256, tags["a"])
+		assert.Nil(t, rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], b))
+	case ed25519.PublicKey:
+		assert.Equal(t, DKIM_ED25519_SHA256, tags["a"])
+		assert.True(t, ed25519.Verify(public, digest[:], b))
+	}
+}
+
+func TestRelaxedCanonicalization(t *testing.T) {
+	// The example of RFC 6376, section 3.4.5.
+	assert.Equal(t, "a:X\r\n", relaxedHeader("A: X\r\n"))
+	assert.Equal(t, "b:Y Z\r\n", relaxedHeader("B : Y\t\r\n\tZ  \r\n"))
+	assert.Equal(t, " C\r\nD E\r\n", string(relaxedBody([]byte(" C \r\nD \t E\r\n\r\n\r\n"))))
+	assert.Equal(t, "", string(relaxedBody([]byte("\r\n\r\n"))))
+}
+
+func TestDKIMSigner_RSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+
+	message := newTestMessage(map[string]string{
+		CONF_DKIM_DOMAIN:   "example.com",
+		CONF_DKIM_SELECTOR: "snail",
+		CONF_DKIM_KEY:      writeDKIMKey(t, testWorkdir(t), key),
+	})
+	message.Body = []string{"Hello,   world.  ", "", ""}
+
+	envelope, err := prepareEnvelope(message)
+	require.Nil(t, err)
+
+	assert.True(t, strings.HasPrefix(string(envelope.Data), "DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.com; s=snail;"))
+	verifyDKIMSignature(t, envelope.Data, key.Public())
+}
+
+func TestDKIMSigner_Ed25519(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+
+	message := newTestMessage(map[string]string{
+		CONF_DKIM_DOMAIN:   "example.com",
+		CONF_DKIM_SELECTOR: "snail",
+		CONF_DKIM_KEY:      writeDKIMKey(t, testWorkdir(t), key),
+	})
+
+	signer, err := newDKIMSigner(message)
+	require.Nil(t, err)
+
+	data := []byte("From: me@example.com\r\nSubject: Hi\r\nX-Other: not signed\r\n\r\nHello.\r\n")
+
+	signed, err := signer.Sign(data, time.Unix(1500000000, 0))
+	require.Nil(t, err)
+
+	assert.Contains(t, string(signed), "t=1500000000; h=From:Subject;")
+	verifyDKIMSignature(t, signed, key.Public())
+}
+
+func TestVerifyDKIM(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+
+	message := newTestMessage(map[string]string{
+		CONF_DKIM_DOMAIN:   "example.com",
+		CONF_DKIM_SELECTOR: "snail",
+		CONF_DKIM_KEY:      writeDKIMKey(t, testWorkdir(t), key),
+	})
+	assert.Nil(t, verifyDKIM(message))
+
+	message.Conf.Set(CONF_FROM, "me@mail.example.com")
+	assert.Nil(t, verifyDKIM(message))
+
+	message.Conf.Set(CONF_FROM, "me@example.org")
+	assert.NotNil(t, verifyDKIM(message))
+
+	message.Conf.Set(CONF_FROM, "me@example.com")
+	message.Conf.Set(CONF_DKIM_KEY, "/nonexistent/dkim.pem")
+	assert.NotNil(t, verifyDKIM(message))
+
+	message.Conf.Set(CONF_DKIM_KEY, "")
+	assert.NotNil(t, verifyDKIM(message))
+
+	// No DKIM settings at all are fine.
+	assert.Nil(t, verifyDKIM(NewMessage()))
+}
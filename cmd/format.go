@@ -0,0 +1,137 @@
+/* format.go: plain text, Markdown and HTML message bodies
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	. "github.com/githubert/lettersnail/common"
+	"github.com/jordan-wright/email"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// Supported values for CONF_FORMAT, how the body of a message is written.
+const (
+	FORMAT_TEXT     = "text"
+	FORMAT_MARKDOWN = "markdown"
+	FORMAT_HTML     = "html"
+)
+
+// Return the format of the message body, FORMAT_TEXT if none is set.
+func bodyFormat(message *Message) (string, error) {
+	format := strings.ToLower(message.Get(CONF_FORMAT))
+
+	switch format {
+	case "":
+		return FORMAT_TEXT, nil
+	case FORMAT_TEXT, FORMAT_MARKDOWN, FORMAT_HTML:
+		return format, nil
+	}
+
+	return "", fmt.Errorf("unknown '%s' '%s'", CONF_FORMAT, format)
+}
+
+// Set the body of the email according to the format of the message. Markdown
+// and HTML bodies are sent as multipart/alternative, with a plain text part
+// for those who do not read HTML.
+func setBody(message *Message, e *email.Email) error {
+	format, err := bodyFormat(message)
+
+	if err != nil {
+		return err
+	}
+
+	body := strings.Join(message.Body, "\n")
+
+	switch format {
+	case FORMAT_MARKDOWN:
+		// Markdown is meant to be readable as it is.
+		var rendered bytes.Buffer
+
+		if err := markdown.Convert([]byte(body), &rendered); err != nil {
+			return err
+		}
+
+		e.Text = []byte(body)
+		e.HTML = rendered.Bytes()
+	case FORMAT_HTML:
+		e.Text = []byte(htmlToText(body))
+		e.HTML = []byte(body)
+	default:
+		e.Text = []byte(body)
+	}
+
+	return nil
+}
+
+// GitHub Flavored Markdown, for tables and links written as bare URLs. Raw
+// HTML in the body is left out.
+var markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+var (
+	htmlHidden     = regexp.MustCompile(`(?is)<(head|script|style)\b.*?</(head|script|style)\s*>`)
+	htmlComment    = regexp.MustCompile(`(?s)<!--.*?-->`)
+	htmlSpace      = regexp.MustCompile(`\s+`)
+	htmlLink       = regexp.MustCompile(`(?is)<a\b[^>]*?\bhref\s*=\s*["']([^"']*)["'][^>]*>(.*?)</a\s*>`)
+	htmlLineBreak  = regexp.MustCompile(`(?i)<br\b[^>]*>`)
+	htmlListItem   = regexp.MustCompile(`(?i)<li\b[^>]*>`)
+	htmlBlock      = regexp.MustCompile(`(?i)</?(p|div|h[1-6]|ul|ol|table|tr|blockquote|pre|hr)\b[^>]*>`)
+	htmlTag        = regexp.MustCompile(`<[^>]*>`)
+	textBlankLines = regexp.MustCompile(`\n{3,}`)
+)
+
+// Turn an HTML body into plain text: paragraphs are separated by blank lines,
+// list items start with "- " and links are followed by their address.
+// Anything else is simply left out.
+func htmlToText(body string) string {
+	text := htmlHidden.ReplaceAllString(body, "")
+	text = htmlComment.ReplaceAllString(text, "")
+	text = htmlSpace.ReplaceAllString(text, " ")
+
+	text = htmlLink.ReplaceAllStringFunc(text, func(link string) string {
+		m := htmlLink.FindStringSubmatch(link)
+		href, label := m[1], m[2]
+
+		if strings.TrimSpace(htmlTag.ReplaceAllString(label, "")) == href {
+			return label
+		}
+
+		return fmt.Sprintf("%s (%s)", label, href)
+	})
+
+	text = htmlLineBreak.ReplaceAllString(text, "\n")
+	text = htmlListItem.ReplaceAllString(text, "\n- ")
+	text = htmlBlock.ReplaceAllString(text, "\n\n")
+	text = htmlTag.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+
+	lines := strings.Split(text, "\n")
+
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+
+	text = strings.Join(lines, "\n")
+	text = textBlankLines.ReplaceAllString(text, "\n\n")
+
+	return strings.TrimSpace(text) + "\n"
+}
@@ -0,0 +1,89 @@
+/* format_test.go: tests for Markdown and HTML message bodies
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	. "github.com/githubert/lettersnail/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestSetBody_Markdown(t *testing.T) {
+	message := newTestMessage(map[string]string{CONF_FORMAT: "Markdown"})
+	message.Body = []string{
+		"# Shopping",
+		"",
+		"- [Milk](https://example.com/milk)",
+		"- Bread",
+		"",
+		"Thanks!"}
+
+	e, err := prepareEmail(message)
+	require.Nil(t, err)
+
+	assert.Equal(t, "# Shopping\n\n- [Milk](https://example.com/milk)\n- Bread\n\nThanks!", string(e.Text))
+	assert.Contains(t, string(e.HTML), "<h1>Shopping</h1>")
+	assert.Contains(t, string(e.HTML), `<li><a href="https://example.com/milk">Milk</a></li>`)
+
+	data, err := e.Bytes()
+	require.Nil(t, err)
+
+	mediaType, _, parts := multipartParts(t, data)
+	assert.Equal(t, "multipart/alternative", mediaType)
+	require.Equal(t, 2, len(parts))
+	assert.Contains(t, parts[0], "Content-Type: text/plain")
+	assert.Contains(t, parts[1], "Content-Type: text/html")
+}
+
+func TestSetBody_HTML(t *testing.T) {
+	message := newTestMessage(map[string]string{CONF_FORMAT: FORMAT_HTML})
+	message.Body = []string{
+		"<html><head><title>Ignored</title></head><body>",
+		"<p>Hello,<br>here is the <b>list</b>:</p>",
+		"<ul>",
+		"  <li><a href=\"https://example.com/milk\">Milk</a></li>",
+		"  <li><a href=\"https://example.com\">https://example.com</a></li>",
+		"</ul>",
+		"<p>Fish &amp; chips</p>",
+		"</body></html>"}
+
+	e, err := prepareEmail(message)
+	require.Nil(t, err)
+
+	assert.Contains(t, string(e.HTML), "<b>list</b>")
+	assert.Equal(t, "Hello,\nhere is the list:\n\n- Milk (https://example.com/milk)\n- https://example.com\n\nFish & chips\n", string(e.Text))
+}
+
+func TestSetBody_Text(t *testing.T) {
+	for _, format := range []string{"", FORMAT_TEXT} {
+		message := newTestMessage(map[string]string{CONF_FORMAT: format})
+		message.Body = []string{"# Not a heading"}
+
+		e, err := prepareEmail(message)
+		require.Nil(t, err)
+
+		assert.Equal(t, "# Not a heading", string(e.Text))
+		assert.Nil(t, e.HTML)
+	}
+
+	message := newTestMessage(map[string]string{CONF_FORMAT: "rtf"})
+	_, err := prepareEmail(message)
+	assert.NotNil(t, err)
+	assert.False(t, checkMessage(*message, true))
+}
@@ -0,0 +1,232 @@
+/* lmtp.go: deliver messages to a local mail store through LMTP
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"context"
+	"fmt"
+	. "github.com/githubert/lettersnail/common"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// The port assigned to LMTP, for addresses without one.
+const LMTP_PORT = "24"
+
+// Delivers messages to a mail store like Dovecot or Cyrus through LMTP (RFC
+// 2033), over a Unix socket or TCP. Unlike SMTP, the server replies for each
+// recipient after the message was sent, as it stores the message right away.
+// The session is kept open between messages until Close is called.
+type lmtpTransport struct {
+	network string
+	addr    string
+	session mailSession
+
+	connectTimeout time.Duration
+	commandTimeout time.Duration
+}
+
+// Parse CONF_LMTP: the path of a Unix socket, possibly prefixed with
+// "unix:", or HOST[:PORT].
+func lmtpAddress(value string) (string, string, error) {
+	switch {
+	case value == "":
+		return "", "", fmt.Errorf("'%s' parameter is missing", CONF_LMTP)
+	case strings.HasPrefix(value, "unix:"):
+		return "unix", strings.TrimPrefix(value, "unix:"), nil
+	case strings.HasPrefix(value, "/"):
+		return "unix", value, nil
+	}
+
+	if _, _, err := net.SplitHostPort(value); err != nil {
+		value = net.JoinHostPort(strings.Trim(value, "[]"), LMTP_PORT)
+	}
+
+	return "tcp", value, nil
+}
+
+func newLMTPTransport(message *Message) (Transport, error) {
+	network, addr, err := lmtpAddress(message.Get(CONF_LMTP))
+
+	if err != nil {
+		return nil, err
+	}
+
+	connectTimeout, err := timeout(message, CONF_CONNECT_TIMEOUT, DEFAULT_CONNECT_TIMEOUT)
+
+	if err != nil {
+		return nil, err
+	}
+
+	commandTimeout, err := timeout(message, CONF_COMMAND_TIMEOUT, DEFAULT_COMMAND_TIMEOUT)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &lmtpTransport{
+		network:        network,
+		addr:           addr,
+		connectTimeout: connectTimeout,
+		commandTimeout: commandTimeout,
+	}, nil
+}
+
+func (t *lmtpTransport) String() string {
+	return fmt.Sprintf("lmtp: %s:%s", t.network, t.addr)
+}
+
+func (t *lmtpTransport) Close() error {
+	t.session.close()
+	return nil
+}
+
+// The commands of an LMTP session.
+type lmtpClient struct {
+	text *textproto.Conn
+}
+
+// Send a command and check the reply.
+func (c *lmtpClient) cmd(expect int, format string, args ...interface{}) error {
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return err
+	}
+
+	_, _, err := c.text.ReadResponse(expect)
+
+	return err
+}
+
+func (c *lmtpClient) Reset() error {
+	return c.cmd(250, "RSET")
+}
+
+func (c *lmtpClient) Quit() error {
+	if err := c.cmd(221, "QUIT"); err != nil {
+		return err
+	}
+
+	return c.text.Close()
+}
+
+func (c *lmtpClient) Close() error {
+	return c.text.Close()
+}
+
+// Return a session that is ready for the next message, the existing one if
+// it still answers.
+func (t *lmtpTransport) connect(ctx context.Context) (*lmtpClient, error) {
+	if t.session.reuse(ctx) {
+		return t.session.client.(*lmtpClient), nil
+	}
+
+	raw, err := dialWithin(ctx, &net.Dialer{}, t.network, t.addr, t.connectTimeout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &deadlineConn{Conn: raw, ctx: ctx, timeout: t.commandTimeout}
+	c := &lmtpClient{text: textproto.NewConn(conn)}
+
+	if _, _, err := c.text.ReadResponse(220); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if err := c.cmd(250, "LHLO localhost"); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	t.session.open(c, conn)
+
+	return c, nil
+}
+
+func (t *lmtpTransport) Deliver(ctx context.Context, envelope *Envelope) (*Delivery, error) {
+	c, err := t.connect(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	statuses, err := sendLMTP(c, envelope)
+	t.session.dropUnlessReply(err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Delivery{Info: fmt.Sprintf("Stored through %s.", t), Recipients: statuses}, nil
+}
+
+// Send the message, and collect the replies for each recipient: either to
+// RCPT, or for those accepted, after the message itself.
+func sendLMTP(c *lmtpClient, envelope *Envelope) ([]RecipientStatus, error) {
+	if err := c.cmd(250, "MAIL FROM:<%s>", envelope.From); err != nil {
+		return nil, err
+	}
+
+	statuses, accepted, err := announceRecipients(envelope.Recipients, func(addr string) error {
+		return c.cmd(250, "RCPT TO:<%s>", addr)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.cmd(354, "DATA"); err != nil {
+		return nil, err
+	}
+
+	w := c.text.DotWriter()
+
+	if _, err := w.Write(envelope.Data); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	// One reply for each accepted recipient, in the same order.
+	stored := 0
+
+	for _, i := range accepted {
+		_, _, err := c.text.ReadResponse(250)
+
+		if err != nil && !isReply(err) {
+			return nil, err
+		}
+
+		if err == nil {
+			stored++
+		}
+
+		statuses[i].Err = err
+	}
+
+	if stored == 0 {
+		return nil, allRejected(statuses)
+	}
+
+	return statuses, nil
+}
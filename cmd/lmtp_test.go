@@ -0,0 +1,150 @@
+/* lmtp_test.go: tests for the LMTP transport
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	. "github.com/githubert/lettersnail/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Start a fake LMTP server on the given network, "unix" or "tcp".
+func newFakeLMTPServer(t *testing.T, network string) *fakeSMTPServer {
+	addr := "127.0.0.1:0"
+
+	if network == "unix" {
+		addr = filepath.Join(testWorkdir(t), "lmtp")
+	}
+
+	l, err := net.Listen(network, addr)
+	require.Nil(t, err)
+
+	s := &fakeSMTPServer{listener: l, lmtp: true}
+	t.Cleanup(s.Close)
+
+	go s.serve()
+
+	return s
+}
+
+func TestLMTPAddress(t *testing.T) {
+	for _, test := range []struct{ value, network, addr string }{
+		{"/run/dovecot/lmtp", "unix", "/run/dovecot/lmtp"},
+		{"unix:lmtp.sock", "unix", "lmtp.sock"},
+		{"mail.example.com", "tcp", "mail.example.com:24"},
+		{"mail.example.com:2424", "tcp", "mail.example.com:2424"},
+		{"::1", "tcp", "[::1]:24"},
+	} {
+		network, addr, err := lmtpAddress(test.value)
+		require.Nil(t, err)
+		assert.Equal(t, test.network, network, test.value)
+		assert.Equal(t, test.addr, addr, test.value)
+	}
+
+	_, _, err := lmtpAddress("")
+	assert.NotNil(t, err)
+}
+
+func TestLMTPTransport(t *testing.T) {
+	for _, network := range []string{"unix", "tcp"} {
+		server := newFakeLMTPServer(t, network)
+
+		message := newTestMessage(map[string]string{
+			CONF_TRANSPORT: TRANSPORT_LMTP,
+			CONF_LMTP:      server.Addr(),
+		})
+		message.Body = []string{"Hello.", ".", "Bye."}
+
+		r := newRunner(time.Now(), false, false)
+
+		delivery, err := r.sendMessage(*message, nil)
+		require.Nil(t, err, network)
+		assert.Contains(t, delivery.Info, "lmtp: "+network)
+
+		_, err = r.sendMessage(*message, nil)
+		require.Nil(t, err, network)
+
+		r.close()
+
+		mails := server.Mails()
+		require.Equal(t, 2, len(mails))
+		assert.Equal(t, "me@example.com", mails[0].from)
+		assert.Equal(t, []string{"you@example.com"}, mails[0].to)
+		assert.Contains(t, mails[0].data, "Hello.\n.\nBye.")
+
+		// Both messages went through the same session.
+		connections, _, _ := server.Counts()
+		assert.Equal(t, 1, connections)
+	}
+}
+
+func TestLMTPTransport_Recipients(t *testing.T) {
+	server := newFakeLMTPServer(t, "unix")
+	server.reject = "nobody@example.com"
+	server.full = "full@example.com"
+
+	settings := map[string]string{
+		CONF_TRANSPORT: TRANSPORT_LMTP,
+		CONF_LMTP:      server.Addr(),
+	}
+
+	message := newTestMessage(settings)
+	message.Conf.Set(CONF_CC, "nobody@example.com, full@example.com")
+
+	r := newRunner(time.Now(), false, false)
+	defer r.close()
+
+	delivery, err := r.sendMessage(*message, nil)
+	require.Nil(t, err)
+
+	require.Equal(t, 3, len(delivery.Recipients))
+	assert.Nil(t, delivery.Recipients[0].Err)
+	assert.False(t, isTemporary(delivery.Recipients[1].Err))
+	assert.True(t, isTemporary(delivery.Recipients[2].Err))
+	assert.Contains(t, delivery.Recipients[2].Err.Error(), "Mailbox is full")
+
+	// Nobody got it: the full mailbox is worth another try.
+	message.Conf.Set(CONF_TO, "full@example.com")
+	message.Conf.Set(CONF_CC, "")
+
+	_, err = r.sendMessage(*message, nil)
+	require.NotNil(t, err)
+	assert.True(t, isTemporary(err))
+
+	// The session survives.
+	_, err = r.sendMessage(*newTestMessage(settings), nil)
+	require.Nil(t, err)
+
+	connections, _, _ := server.Counts()
+	assert.Equal(t, 1, connections)
+	assert.Equal(t, 2, len(server.Mails()))
+}
+
+func TestLMTPTransport_Unreachable(t *testing.T) {
+	err := trySend(newTestMessage(map[string]string{
+		CONF_TRANSPORT: TRANSPORT_LMTP,
+		CONF_LMTP:      closedAddr(t),
+	}))
+
+	require.NotNil(t, err)
+	assert.True(t, isTemporary(err))
+}
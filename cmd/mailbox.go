@@ -0,0 +1,284 @@
+/* mailbox.go: deliver messages into a local Maildir or mbox
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	. "github.com/githubert/lettersnail/common"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// How long to wait for somebody else to release the lock on an mbox.
+	MBOX_LOCK_TIMEOUT = 10 * time.Second
+
+	// A `.lock` file older than this was left behind by a crashed program,
+	// and is removed. Mutt and procmail use the same.
+	MBOX_STALE_LOCK = 5 * time.Minute
+)
+
+// Counter for unique Maildir file names within this process.
+var maildirCounter uint64
+
+// Delivers messages into a Maildir.
+type maildirTransport struct {
+	path string
+}
+
+func newMaildirTransport(message *Message) (Transport, error) {
+	path := message.Get(CONF_MAILDIR)
+
+	if path == "" {
+		return nil, fmt.Errorf("'%s' parameter is missing", CONF_MAILDIR)
+	}
+
+	return &maildirTransport{path: path}, nil
+}
+
+func (t *maildirTransport) Close() error {
+	return nil
+}
+
+func (t *maildirTransport) String() string {
+	return "maildir: " + t.path
+}
+
+// Build a unique file name as described on https://cr.yp.to/proto/maildir.html
+func maildirName(now time.Time) string {
+	host, err := os.Hostname()
+
+	if err != nil {
+		host = "localhost"
+	}
+
+	host = strings.Replace(host, "/", "\\057", -1)
+	host = strings.Replace(host, ":", "\\072", -1)
+
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s",
+		now.Unix(),
+		now.Nanosecond()/1000,
+		os.Getpid(),
+		atomic.AddUint64(&maildirCounter, 1),
+		host)
+}
+
+// The message is written to tmp/ first, and then moved to new/, so that
+// readers of the Maildir never see a partially written message.
+func (t *maildirTransport) Deliver(ctx context.Context, envelope *Envelope) (*Delivery, error) {
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(t.path, dir), 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	name := maildirName(time.Now())
+	tmp := filepath.Join(t.path, "tmp", name)
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = f.Write(localMessage(envelope))
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	dst := filepath.Join(t.path, "new", name)
+
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	return &Delivery{Info: fmt.Sprintf("Delivered to %s.", dst)}, nil
+}
+
+// Appends messages to an mbox file.
+type mboxTransport struct {
+	path string
+}
+
+func newMboxTransport(message *Message) (Transport, error) {
+	path := message.Get(CONF_MBOX)
+
+	if path == "" {
+		return nil, fmt.Errorf("'%s' parameter is missing", CONF_MBOX)
+	}
+
+	return &mboxTransport{path: path}, nil
+}
+
+func (t *mboxTransport) Close() error {
+	return nil
+}
+
+func (t *mboxTransport) String() string {
+	return "mbox: " + t.path
+}
+
+func (t *mboxTransport) Deliver(ctx context.Context, envelope *Envelope) (*Delivery, error) {
+	unlock, err := dotlock(t.path, MBOX_LOCK_TIMEOUT)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer unlock()
+
+	f, err := os.OpenFile(t.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Closing the file releases the lock.
+	err = lockFile(f, MBOX_LOCK_TIMEOUT)
+
+	if err == nil {
+		_, err = f.Write(mboxEntry(envelope, time.Now()))
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Delivery{Info: fmt.Sprintf("Appended to %s.", t.path)}, nil
+}
+
+var fromLine = regexp.MustCompile(`(?m)^(>*From )`)
+
+// Build an mbox entry: a From_ line, followed by the message, where lines
+// starting with "From " (possibly preceded by '>') are quoted as in mboxrd,
+// and finally an empty line.
+func mboxEntry(envelope *Envelope, now time.Time) []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "From %s %s\n", envelope.From, now.UTC().Format(time.ANSIC))
+
+	buf.Write(fromLine.ReplaceAll(localMessage(envelope), []byte(">$1")))
+
+	if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		buf.WriteString("\n")
+	}
+
+	buf.WriteString("\n")
+
+	return buf.Bytes()
+}
+
+// The message as stored locally: with a Return-Path, like a delivery agent
+// would add it, and plain newlines.
+func localMessage(envelope *Envelope) []byte {
+	data := []byte(fmt.Sprintf("Return-Path: <%s>\n", envelope.From))
+
+	return append(data, unixLineEndings(envelope.Data)...)
+}
+
+// Acquire a dot-lock (`path` + ".lock") as used by most mail programs. The
+// returned function releases the lock.
+func dotlock(path string, timeout time.Duration) (func(), error) {
+	lock := path + ".lock"
+	deadline := time.Now().Add(timeout)
+
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+
+			return func() { os.Remove(lock) }, nil
+		}
+
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if info, err := os.Stat(lock); err == nil && time.Since(info.ModTime()) > MBOX_STALE_LOCK {
+			os.Remove(lock)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, temporary(fmt.Errorf("timeout while waiting for lock %s", lock))
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Lock the open file `f` with both flock(2) and fcntl(2), for programs that
+// only use one of them.
+func lockFile(f *os.File, timeout time.Duration) error {
+	fd := int(f.Fd())
+	deadline := time.Now().Add(timeout)
+
+	for {
+		err := syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB)
+
+		if err == nil {
+			err = syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &syscall.Flock_t{Type: syscall.F_WRLCK})
+
+			if err != nil {
+				syscall.Flock(fd, syscall.LOCK_UN)
+			}
+		}
+
+		if err == nil {
+			return nil
+		}
+
+		if err != syscall.EWOULDBLOCK && err != syscall.EAGAIN && err != syscall.EACCES {
+			return err
+		}
+
+		if time.Now().After(deadline) {
+			return temporary(fmt.Errorf("timeout while waiting for lock on %s", f.Name()))
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
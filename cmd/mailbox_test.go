@@ -0,0 +1,134 @@
+/* mailbox_test.go: unit tests for the Maildir and mbox transports
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	. "github.com/githubert/lettersnail/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaildirTransport(t *testing.T) {
+	maildir := filepath.Join(testWorkdir(t), "Maildir")
+
+	message := newTestMessage(map[string]string{
+		CONF_TRANSPORT: TRANSPORT_MAILDIR,
+		CONF_MAILDIR:   maildir,
+	})
+
+	require.Nil(t, trySend(message))
+	require.Nil(t, trySend(message))
+
+	tmp, err := ioutil.ReadDir(filepath.Join(maildir, "tmp"))
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(tmp))
+
+	files, err := ioutil.ReadDir(filepath.Join(maildir, "new"))
+	require.Nil(t, err)
+	require.Equal(t, 2, len(files))
+	assert.NotEqual(t, files[0].Name(), files[1].Name())
+
+	data, err := ioutil.ReadFile(filepath.Join(maildir, "new", files[0].Name()))
+	require.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "Return-Path: <me@example.com>\n"))
+	assert.NotContains(t, string(data), "\r\n")
+}
+
+func TestMboxTransport(t *testing.T) {
+	mbox := filepath.Join(testWorkdir(t), "mbox")
+
+	message := newTestMessage(map[string]string{
+		CONF_TRANSPORT: TRANSPORT_MBOX,
+		CONF_MBOX:      mbox,
+	})
+	message.Body = []string{"From here on, everything is fine.", ">From the start."}
+
+	require.Nil(t, trySend(message))
+	require.Nil(t, trySend(message))
+
+	data, err := ioutil.ReadFile(mbox)
+	require.Nil(t, err)
+
+	content := string(data)
+
+	assert.True(t, strings.HasPrefix(content, "From me@example.com "))
+	assert.Equal(t, 2, strings.Count(content, "\nFrom me@example.com ")+1)
+	assert.Equal(t, 2, strings.Count(content, "\n>From here on"))
+	assert.Equal(t, 2, strings.Count(content, "\n>>From the start."))
+	assert.True(t, strings.HasSuffix(content, "\n\n"))
+
+	_, err = os.Stat(mbox + ".lock")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDotlock(t *testing.T) {
+	workdir := testWorkdir(t)
+	path := filepath.Join(workdir, "mbox")
+
+	unlock, err := dotlock(path, time.Second)
+	require.Nil(t, err)
+
+	// Somebody else holds the lock.
+	_, err = dotlock(path, 200*time.Millisecond)
+	assert.NotNil(t, err)
+
+	unlock()
+
+	// A lock left behind long ago is broken.
+	unlock, err = dotlock(path, time.Second)
+	require.Nil(t, err)
+
+	old := time.Now().Add(-2 * MBOX_STALE_LOCK)
+	require.Nil(t, os.Chtimes(path+".lock", old, old))
+
+	unlock, err = dotlock(path, 200*time.Millisecond)
+	require.Nil(t, err)
+
+	// A lock held by someone else is only waited for.
+	_, err = dotlock(path, 200*time.Millisecond)
+	require.NotNil(t, err)
+	assert.True(t, isTemporary(err))
+	unlock()
+}
+
+func TestLockFile(t *testing.T) {
+	workdir := testWorkdir(t)
+	path := filepath.Join(workdir, "mbox")
+
+	first, err := os.Create(path)
+	require.Nil(t, err)
+	require.Nil(t, lockFile(first, time.Second))
+
+	// flock(2) locks also keep out other descriptors of the same process.
+	second, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	require.Nil(t, err)
+	defer second.Close()
+
+	err = lockFile(second, 200*time.Millisecond)
+	require.NotNil(t, err)
+	assert.True(t, isTemporary(err))
+
+	first.Close()
+	assert.Nil(t, lockFile(second, time.Second))
+}
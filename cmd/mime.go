@@ -0,0 +1,253 @@
+/* mime.go: taking rendered messages apart and putting them together again
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// Split a message into its header, including the final line break, and its
+// body.
+func splitHeader(data []byte) ([]byte, []byte) {
+	i := bytes.Index(data, []byte("\r\n\r\n"))
+
+	if i < 0 {
+		return data, nil
+	}
+
+	return data[:i+2], data[i+4:]
+}
+
+// Split a header into its fields, each including its continuation lines and
+// final line break.
+func headerLines(header []byte) []string {
+	fields := []string{}
+	lines := strings.SplitAfter(string(header), "\r\n")
+
+	for i := 0; i < len(lines); i++ {
+		field := lines[i]
+
+		for i+1 < len(lines) && (strings.HasPrefix(lines[i+1], " ") || strings.HasPrefix(lines[i+1], "\t")) {
+			i++
+			field += lines[i]
+		}
+
+		if strings.Index(field, ":") > 0 {
+			fields = append(fields, field)
+		}
+	}
+
+	return fields
+}
+
+// The lower case name of a header field.
+func fieldName(field string) string {
+	return strings.ToLower(strings.TrimSpace(field[:strings.Index(field, ":")]))
+}
+
+// Collect the header fields of a message by their lower case name. If a field
+// occurs more than once, the last one wins.
+func headerFields(header []byte) map[string]string {
+	fields := map[string]string{}
+
+	for _, field := range headerLines(header) {
+		fields[fieldName(field)] = field
+	}
+
+	return fields
+}
+
+// Split a rendered message into the header fields describing the message
+// (From, Subject, ...), and the MIME entity holding its content: the Content-*
+// fields and the body. This entity can then be signed or encrypted, and put
+// back into a new message.
+func splitContent(data []byte) ([]string, []byte) {
+	header, body := splitHeader(data)
+
+	outer := []string{}
+
+	var entity bytes.Buffer
+
+	for _, field := range headerLines(header) {
+		name := fieldName(field)
+
+		if strings.HasPrefix(name, "content-") {
+			entity.WriteString(field)
+		} else if name != "mime-version" {
+			outer = append(outer, field)
+		}
+	}
+
+	entity.WriteString("\r\n")
+	entity.Write(body)
+
+	return outer, entity.Bytes()
+}
+
+// Build a message from the given header fields, and a multipart body with the
+// given content type and parts.
+func multipartMessage(fields []string, contentType string, boundary string, parts ...[]byte) []byte {
+	var buf bytes.Buffer
+
+	for _, field := range fields {
+		buf.WriteString(field)
+	}
+
+	buf.WriteString("Mime-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: " + contentType + ";\r\n\tboundary=\"" + boundary + "\"\r\n")
+
+	for _, part := range parts {
+		buf.WriteString("\r\n--" + boundary + "\r\n")
+		buf.Write(part)
+	}
+
+	buf.WriteString("\r\n--" + boundary + "--\r\n")
+
+	return buf.Bytes()
+}
+
+// Build a message from the given header fields and a single MIME entity, as
+// returned by splitContent.
+func entityMessage(fields []string, entity []byte) []byte {
+	var buf bytes.Buffer
+
+	for _, field := range fields {
+		buf.WriteString(field)
+	}
+
+	buf.WriteString("Mime-Version: 1.0\r\n")
+	buf.Write(entity)
+
+	return buf.Bytes()
+}
+
+// Describe the MIME structure of a message, one line per part, indented by
+// nesting level. The content of signed S/MIME data is shown as well.
+func mimeTree(data []byte) ([]string, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(msg.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []string{}
+
+	return lines, mimeNode(textproto.MIMEHeader(msg.Header), body, 0, &lines)
+}
+
+func mimeNode(header textproto.MIMEHeader, body []byte, depth int, lines *[]string) error {
+	indent := strings.Repeat("  ", depth)
+	contentType := header.Get("Content-Type")
+
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+
+	if err != nil {
+		return err
+	}
+
+	line := indent + mediaType
+
+	if smimeType := params["smime-type"]; smimeType != "" {
+		line += " (" + smimeType + ")"
+	}
+
+	if name := params["name"]; name != "" {
+		line += " " + name
+	}
+
+	*lines = append(*lines, line)
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		parts := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+
+		for {
+			part, err := parts.NextRawPart()
+
+			if err != nil {
+				break
+			}
+
+			content, err := ioutil.ReadAll(part)
+
+			if err != nil {
+				return err
+			}
+
+			if err := mimeNode(part.Header, content, depth+1, lines); err != nil {
+				return err
+			}
+		}
+	}
+
+	if mediaType == "application/pkcs7-mime" && params["smime-type"] == SMIME_SIGNED_DATA {
+		der, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(body), nil)))
+
+		if err != nil {
+			return err
+		}
+
+		content, err := smimeSignedContent(der)
+
+		if err != nil {
+			return err
+		}
+
+		msg, err := mail.ReadMessage(bytes.NewReader(content))
+
+		if err != nil {
+			return err
+		}
+
+		body, err := ioutil.ReadAll(msg.Body)
+
+		if err != nil {
+			return err
+		}
+
+		return mimeNode(textproto.MIMEHeader(msg.Header), body, depth+1, lines)
+	}
+
+	return nil
+}
+
+// A random MIME boundary.
+func newBoundary() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return "lettersnail-" + hex.EncodeToString(b)
+}
@@ -69,7 +69,7 @@ func Next(argv []string, conf *Configuration) {
 	count := 0
 
 	for _, message := range messages {
-		message.Conf.MergeWith(conf)
+		message.MergeWith(conf)
 
 		if errs := message.Verify(); errs != nil {
 			fmt.Printf("Error in message \"%s\". Please run 'lettersnail check'.\n", message.Name)
@@ -0,0 +1,217 @@
+/* oauth.go: OAuth 2.0 access tokens for SMTP authentication
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/githubert/lettersnail/common"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const OAUTH_TIMEOUT = 30 * time.Second
+
+// An access token that expires within this time is refreshed right away, so
+// that it does not run out in the middle of a session.
+const OAUTH_EXPIRY_MARGIN = time.Minute
+
+// How long an access token is used, if the provider does not tell.
+const OAUTH_DEFAULT_LIFETIME = time.Hour
+
+// The contents of the token file. The client credentials and the refresh token
+// are set up once, the access token and its expiry are kept up to date by
+// lettersnail.
+type oauthToken struct {
+	ClientID     string    `json:"client_id"`
+	ClientSecret string    `json:"client_secret,omitempty"`
+	RefreshToken string    `json:"refresh_token"`
+	AccessToken  string    `json:"access_token,omitempty"`
+	Expiry       time.Time `json:"expiry,omitempty"`
+}
+
+// Hands out access tokens, refreshing them at the token endpoint when they
+// expire.
+type oauthSource struct {
+	file   string
+	url    string
+	client *http.Client
+	now    func() time.Time
+}
+
+func newOAuthSource(message *Message) (*oauthSource, error) {
+	for _, key := range []string{CONF_OAUTH_TOKEN_FILE, CONF_OAUTH_TOKEN_URL} {
+		if message.Get(key) == "" {
+			return nil, fmt.Errorf("'%s' is set to '%s', but '%s' is missing", CONF_SMTP_AUTH, message.Get(CONF_SMTP_AUTH), key)
+		}
+	}
+
+	return &oauthSource{
+		file:   message.Get(CONF_OAUTH_TOKEN_FILE),
+		url:    message.Get(CONF_OAUTH_TOKEN_URL),
+		client: &http.Client{Timeout: OAUTH_TIMEOUT},
+		now:    time.Now,
+	}, nil
+}
+
+// Return a valid access token. A cached one is used as long as it is valid,
+// otherwise a new one is requested and stored in the token file.
+func (s *oauthSource) AccessToken() (string, error) {
+	data, err := ioutil.ReadFile(s.file)
+
+	if err != nil {
+		return "", fmt.Errorf("reading '%s': %s", CONF_OAUTH_TOKEN_FILE, err.Error())
+	}
+
+	token := &oauthToken{}
+
+	if err := json.Unmarshal(data, token); err != nil {
+		return "", fmt.Errorf("reading '%s': %s", CONF_OAUTH_TOKEN_FILE, err.Error())
+	}
+
+	if token.AccessToken != "" && s.now().Add(OAUTH_EXPIRY_MARGIN).Before(token.Expiry) {
+		return token.AccessToken, nil
+	}
+
+	if token.RefreshToken == "" || token.ClientID == "" {
+		return "", fmt.Errorf("%s needs 'client_id' and 'refresh_token'", s.file)
+	}
+
+	if err := s.refresh(token); err != nil {
+		return "", err
+	}
+
+	data, err = json.MarshalIndent(token, "", "  ")
+
+	if err != nil {
+		return "", err
+	}
+
+	if err := writeFileAtomic(s.file, append(data, '\n')); err != nil {
+		return "", err
+	}
+
+	return token.AccessToken, nil
+}
+
+// Exchange the refresh token for a new access token (RFC 6749, section 6).
+func (s *oauthSource) refresh(token *oauthToken) error {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", token.RefreshToken)
+	form.Set("client_id", token.ClientID)
+
+	if token.ClientSecret != "" {
+		form.Set("client_secret", token.ClientSecret)
+	}
+
+	resp, err := s.client.PostForm(s.url, form)
+
+	if err != nil {
+		return fmt.Errorf("refreshing the access token: %s", err.Error())
+	}
+
+	defer resp.Body.Close()
+
+	var reply struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		RefreshToken     string `json:"refresh_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return fmt.Errorf("refreshing the access token: %s", err.Error())
+	}
+
+	// Errors come as JSON as well, so the body is looked at in any case.
+	json.Unmarshal(body, &reply)
+
+	if reply.Error != "" {
+		return fmt.Errorf("refreshing the access token: %s %s", reply.Error, reply.ErrorDescription)
+	}
+
+	if resp.StatusCode != http.StatusOK || reply.AccessToken == "" {
+		return fmt.Errorf("refreshing the access token: %s", resp.Status)
+	}
+
+	lifetime := time.Duration(reply.ExpiresIn) * time.Second
+
+	if lifetime <= 0 {
+		lifetime = OAUTH_DEFAULT_LIFETIME
+	}
+
+	token.AccessToken = reply.AccessToken
+	token.Expiry = s.now().Add(lifetime).UTC().Truncate(time.Second)
+
+	// Some providers hand out a new refresh token with every refresh.
+	if reply.RefreshToken != "" {
+		token.RefreshToken = reply.RefreshToken
+	}
+
+	return nil
+}
+
+// The XOAUTH2 mechanism used by Google and Microsoft.
+type xoauth2Auth struct {
+	user  string
+	token string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "XOAUTH2", []byte("user=" + a.user + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+// On failure, the server sends details as a challenge, which has to be
+// answered with an empty response before it sends the final error.
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return []byte{}, nil
+	}
+
+	return nil, nil
+}
+
+// OAUTHBEARER as in RFC 7628.
+type oauthBearerAuth struct {
+	user  string
+	token string
+}
+
+func (a *oauthBearerAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	user := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(a.user)
+
+	return "OAUTHBEARER", []byte("n,a=" + user + ",\x01host=" + server.Name + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+// Like XOAUTH2, an error challenge is answered with a dummy response
+// (RFC 7628, section 3.2.3).
+func (a *oauthBearerAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return []byte("\x01"), nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,164 @@
+/* oauth_test.go: tests for OAuth 2.0 SMTP authentication
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/githubert/lettersnail/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A fake token endpoint, handing out numbered access tokens.
+type fakeTokenEndpoint struct {
+	*httptest.Server
+	requests int
+
+	// Left out of the reply, if 0.
+	expiresIn int
+}
+
+func newFakeTokenEndpoint(t *testing.T) *fakeTokenEndpoint {
+	e := &fakeTokenEndpoint{expiresIn: 3600}
+
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		if r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("refresh_token") != "refresh-me" ||
+			r.Form.Get("client_id") != "lettersnail" || r.Form.Get("client_secret") != "psst" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "invalid_grant", "error_description": "Bad request."}`)
+			return
+		}
+
+		e.requests++
+
+		reply := map[string]interface{}{
+			"access_token": fmt.Sprintf("access-%d", e.requests),
+			"token_type":   "Bearer",
+		}
+
+		if e.expiresIn > 0 {
+			reply["expires_in"] = e.expiresIn
+		}
+
+		json.NewEncoder(w).Encode(reply)
+	}))
+
+	t.Cleanup(e.Close)
+
+	return e
+}
+
+func writeTokenFile(t *testing.T, token oauthToken) string {
+	file := filepath.Join(testWorkdir(t), "token.json")
+
+	data, err := json.Marshal(token)
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(file, data, 0600))
+
+	return file
+}
+
+func TestOAuthSource_AccessToken(t *testing.T) {
+	endpoint := newFakeTokenEndpoint(t)
+
+	file := writeTokenFile(t, oauthToken{ClientID: "lettersnail", ClientSecret: "psst", RefreshToken: "refresh-me"})
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	source, err := newOAuthSource(newTestMessage(map[string]string{
+		CONF_OAUTH_TOKEN_FILE: file,
+		CONF_OAUTH_TOKEN_URL:  endpoint.URL,
+	}))
+	require.Nil(t, err)
+
+	source.now = func() time.Time { return now }
+
+	token, err := source.AccessToken()
+	require.Nil(t, err)
+	assert.Equal(t, "access-1", token)
+
+	// The token file keeps the token while it is valid. Shortly before it
+	// expires, a new one is requested.
+	now = now.Add(30 * time.Minute)
+
+	token, _ = source.AccessToken()
+	assert.Equal(t, "access-1", token)
+
+	now = now.Add(29*time.Minute + 30*time.Second)
+
+	token, _ = source.AccessToken()
+	assert.Equal(t, "access-2", token)
+	assert.Equal(t, 2, endpoint.requests)
+
+	// Without `expires_in`, a token is kept for OAUTH_DEFAULT_LIFETIME.
+	endpoint.expiresIn = 0
+	now = now.Add(time.Hour)
+
+	token, _ = source.AccessToken()
+	assert.Equal(t, "access-3", token)
+
+	now = now.Add(30 * time.Minute)
+
+	token, _ = source.AccessToken()
+	assert.Equal(t, "access-3", token)
+
+	source.file = writeTokenFile(t, oauthToken{ClientID: "lettersnail", RefreshToken: "revoked"})
+
+	_, err = source.AccessToken()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid_grant")
+}
+
+func TestSmtpAuth_StartOAuth(t *testing.T) {
+	endpoint := newFakeTokenEndpoint(t)
+
+	settings := map[string]string{
+		CONF_SMTP_USER:        "me@example.com",
+		CONF_SMTP_AUTH:        "xoauth2",
+		CONF_OAUTH_TOKEN_FILE: writeTokenFile(t, oauthToken{ClientID: "lettersnail", ClientSecret: "psst", RefreshToken: "refresh-me"}),
+		CONF_OAUTH_TOKEN_URL:  endpoint.URL,
+	}
+
+	auth, err := newAuth(newTestMessage(settings))
+	require.Nil(t, err)
+
+	mech, resp, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: true, Auth: []string{"PLAIN", "XOAUTH2"}})
+	require.Nil(t, err)
+	assert.Equal(t, "XOAUTH2", mech)
+	assert.Equal(t, "user=me@example.com\x01auth=Bearer access-1\x01\x01", string(resp))
+
+	settings[CONF_SMTP_AUTH] = "oauthbearer"
+
+	auth, err = newAuth(newTestMessage(settings))
+	require.Nil(t, err)
+
+	mech, resp, err = auth.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: true, Auth: []string{"OAUTHBEARER"}})
+	require.Nil(t, err)
+	assert.Equal(t, "OAUTHBEARER", mech)
+	assert.Equal(t, "n,a=me@example.com,\x01host=smtp.example.com\x01auth=Bearer access-1\x01\x01", string(resp))
+}
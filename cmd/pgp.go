@@ -0,0 +1,340 @@
+/* pgp.go: OpenPGP signed and encrypted messages (RFC 3156)
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	. "github.com/githubert/lettersnail/common"
+	"io/ioutil"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Supported values for CONF_ENCRYPT and CONF_SIGN.
+const (
+	PROTECT_NONE = ""
+	PROTECT_PGP  = "pgp"
+)
+
+var pgpConfig = &packet.Config{DefaultHash: crypto.SHA256}
+
+// Determine how the message is to be protected, for CONF_ENCRYPT or CONF_SIGN.
+func protection(message *Message, key string) (string, error) {
+	value := strings.ToLower(message.Get(key))
+
+	switch value {
+	case PROTECT_NONE, "no", "false":
+		return PROTECT_NONE, nil
+	case PROTECT_PGP:
+		return value, nil
+	}
+
+	return "", fmt.Errorf("unknown value for '%s': %s", key, value)
+}
+
+// Read all keys from the armored keyring file configured for the message.
+// The file may contain several armored blocks, like public keys exported one
+// after the other.
+func loadKeyring(message *Message) (openpgp.EntityList, error) {
+	file := message.Get(CONF_PGP_KEYRING)
+
+	if file == "" {
+		return nil, fmt.Errorf("'%s' parameter is missing", CONF_PGP_KEYRING)
+	}
+
+	data, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keyring := openpgp.EntityList{}
+
+	// The armor decoder reads ahead, so each block is decoded on its own.
+	blocks := strings.Split(string(data), "-----BEGIN ")
+
+	for _, text := range blocks[1:] {
+		block, err := armor.Decode(strings.NewReader("-----BEGIN " + text))
+
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %s", file, err.Error())
+		}
+
+		entities, err := openpgp.ReadKeyRing(block.Body)
+
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %s", file, err.Error())
+		}
+
+		keyring = append(keyring, entities...)
+	}
+
+	if len(keyring) == 0 {
+		return nil, fmt.Errorf("%s contains no armored keys", file)
+	}
+
+	return keyring, nil
+}
+
+// Find a key for the given address. With `secret`, only keys that can sign
+// are considered, otherwise only keys that can encrypt.
+func findKey(keyring openpgp.EntityList, address string, secret bool) *openpgp.Entity {
+	now := time.Now()
+
+	for _, entity := range keyring {
+		if secret && entity.PrivateKey == nil {
+			continue
+		}
+
+		if secret {
+			if _, ok := entity.SigningKey(now); !ok {
+				continue
+			}
+		} else if _, ok := entity.EncryptionKey(now); !ok {
+			continue
+		}
+
+		for _, identity := range entity.Identities {
+			if identity.UserId != nil && strings.EqualFold(identity.UserId.Email, address) {
+				return entity
+			}
+		}
+	}
+
+	return nil
+}
+
+// The key to sign the message with, belonging to its sender. An encrypted key
+// is unlocked with CONF_PGP_PASSPHRASE.
+func pgpSigner(message *Message, keyring openpgp.EntityList) (*openpgp.Entity, error) {
+	from, err := mail.ParseAddress(message.Get(CONF_FROM))
+
+	if err != nil {
+		return nil, err
+	}
+
+	signer := findKey(keyring, from.Address, true)
+
+	if signer == nil {
+		return nil, fmt.Errorf("no secret PGP key for %s", from.Address)
+	}
+
+	if signer.PrivateKey.Encrypted {
+		if err := signer.DecryptPrivateKeys([]byte(message.Get(CONF_PGP_PASSPHRASE))); err != nil {
+			return nil, fmt.Errorf("unlocking the PGP key for %s: %s", from.Address, err.Error())
+		}
+	}
+
+	return signer, nil
+}
+
+// The keys of all recipients. All missing keys are reported at once.
+func pgpRecipients(keyring openpgp.EntityList, recipients []string) ([]*openpgp.Entity, error) {
+	keys := []*openpgp.Entity{}
+	missing := []string{}
+
+	for _, recipient := range recipients {
+		if key := findKey(keyring, recipient, false); key != nil {
+			keys = append(keys, key)
+		} else {
+			missing = append(missing, recipient)
+		}
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("no PGP key for %s", strings.Join(missing, ", "))
+	}
+
+	return keys, nil
+}
+
+// Check the PGP settings of the given message: all keys needed for signing
+// and encrypting have to be in the keyring.
+func verifyPGP(message *Message) []error {
+	encrypt, err := protection(message, CONF_ENCRYPT)
+
+	if err != nil {
+		return []error{err}
+	}
+
+	sign, err := protection(message, CONF_SIGN)
+
+	if err != nil {
+		return []error{err}
+	}
+
+	if encrypt != PROTECT_PGP && sign != PROTECT_PGP {
+		return nil
+	}
+
+	keyring, err := loadKeyring(message)
+
+	if err != nil {
+		return []error{err}
+	}
+
+	errs := []error{}
+
+	if sign == PROTECT_PGP {
+		if _, err := pgpSigner(message, keyring); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if encrypt == PROTECT_PGP {
+		e, err := prepareEmail(message)
+
+		if err != nil {
+			return append(errs, err)
+		}
+
+		_, recipients, err := envelopeAddresses(e)
+
+		if err != nil {
+			return append(errs, err)
+		}
+
+		if _, err := pgpRecipients(keyring, recipients); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errs
+}
+
+// Sign and/or encrypt the rendered message, as requested by CONF_SIGN and
+// CONF_ENCRYPT. If neither is set to "pgp", the message is returned as it is.
+func pgpProtect(message *Message, data []byte, recipients []string) ([]byte, error) {
+	encrypt, err := protection(message, CONF_ENCRYPT)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sign, err := protection(message, CONF_SIGN)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if encrypt != PROTECT_PGP && sign != PROTECT_PGP {
+		return data, nil
+	}
+
+	keyring, err := loadKeyring(message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var signer *openpgp.Entity
+
+	if sign == PROTECT_PGP {
+		if signer, err = pgpSigner(message, keyring); err != nil {
+			return nil, err
+		}
+	}
+
+	fields, entity := splitContent(data)
+
+	if encrypt == PROTECT_PGP {
+		keys, err := pgpRecipients(keyring, recipients)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return pgpEncrypt(fields, entity, keys, signer)
+	}
+
+	return pgpSign(fields, entity, signer)
+}
+
+// Build a multipart/signed message as described in RFC 3156, section 5.
+func pgpSign(fields []string, entity []byte, signer *openpgp.Entity) ([]byte, error) {
+	var signature bytes.Buffer
+
+	if err := openpgp.ArmoredDetachSign(&signature, signer, bytes.NewReader(entity), pgpConfig); err != nil {
+		return nil, err
+	}
+
+	part := "Content-Type: application/pgp-signature; name=\"signature.asc\"\r\n" +
+		"Content-Description: OpenPGP digital signature\r\n" +
+		"Content-Disposition: attachment; filename=\"signature.asc\"\r\n" +
+		"\r\n" +
+		strings.Replace(signature.String(), "\n", "\r\n", -1) + "\r\n"
+
+	contentType := "multipart/signed; micalg=pgp-sha256;\r\n\tprotocol=\"application/pgp-signature\""
+
+	return multipartMessage(fields, contentType, newBoundary(), entity, []byte(part)), nil
+}
+
+// Build a multipart/encrypted message as described in RFC 3156, section 4. If
+// `signer` is set, the encrypted data is signed as well (section 6.2).
+func pgpEncrypt(fields []string, entity []byte, keys []*openpgp.Entity, signer *openpgp.Entity) ([]byte, error) {
+	var ciphertext bytes.Buffer
+
+	armored, err := armor.Encode(&ciphertext, "PGP MESSAGE", nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := openpgp.Encrypt(armored, keys, signer, nil, pgpConfig)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := plaintext.Write(entity); err != nil {
+		return nil, err
+	}
+
+	if err := plaintext.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := armored.Close(); err != nil {
+		return nil, err
+	}
+
+	version := "Content-Type: application/pgp-encrypted\r\n" +
+		"Content-Description: PGP/MIME version identification\r\n" +
+		"\r\n" +
+		"Version: 1\r\n"
+
+	part := "Content-Type: application/octet-stream; name=\"encrypted.asc\"\r\n" +
+		"Content-Description: OpenPGP encrypted message\r\n" +
+		"Content-Disposition: inline; filename=\"encrypted.asc\"\r\n" +
+		"\r\n" +
+		strings.Replace(ciphertext.String(), "\n", "\r\n", -1) + "\r\n"
+
+	contentType := "multipart/encrypted;\r\n\tprotocol=\"application/pgp-encrypted\""
+
+	return multipartMessage(fields, contentType, newBoundary(), []byte(version), []byte(part)), nil
+}
@@ -0,0 +1,176 @@
+/* pgp_test.go: unit tests for OpenPGP signed and encrypted messages
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"bytes"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	. "github.com/githubert/lettersnail/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"mime"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Keys of the sender and the recipient, and a keyring file holding the
+// sender's secret key and the recipient's public key.
+type pgpKeys struct {
+	sender    *openpgp.Entity
+	recipient *openpgp.Entity
+	keyring   string
+}
+
+func testPGPKeys(t *testing.T) *pgpKeys {
+	sender, err := openpgp.NewEntity("Me", "", "me@example.com", nil)
+	require.Nil(t, err)
+
+	recipient, err := openpgp.NewEntity("You", "", "you@example.com", nil)
+	require.Nil(t, err)
+
+	var buf bytes.Buffer
+
+	w, err := armor.Encode(&buf, openpgp.PrivateKeyType, nil)
+	require.Nil(t, err)
+	require.Nil(t, sender.SerializePrivate(w, nil))
+	require.Nil(t, w.Close())
+
+	buf.WriteString("\n")
+
+	w, err = armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	require.Nil(t, err)
+	require.Nil(t, recipient.Serialize(w))
+	require.Nil(t, w.Close())
+
+	keyring := filepath.Join(testWorkdir(t), "keyring.asc")
+	require.Nil(t, ioutil.WriteFile(keyring, buf.Bytes(), 0600))
+
+	return &pgpKeys{sender: sender, recipient: recipient, keyring: keyring}
+}
+
+// Split a multipart message into its content type and its raw parts.
+func multipartParts(t *testing.T, data []byte) (string, map[string]string, []string) {
+	header, body := splitHeader(data)
+
+	contentType := headerFields(header)["content-type"]
+	mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(contentType[len("Content-Type:"):]))
+	require.Nil(t, err)
+
+	delimiter := "\r\n--" + params["boundary"]
+	parts := strings.Split("\r\n"+string(body), delimiter)
+
+	require.True(t, len(parts) > 2)
+	require.True(t, strings.HasPrefix(parts[len(parts)-1], "--"))
+
+	result := []string{}
+
+	for _, part := range parts[1 : len(parts)-1] {
+		result = append(result, strings.TrimPrefix(part, "\r\n"))
+	}
+
+	return mediaType, params, result
+}
+
+func TestPGPProtect_Sign(t *testing.T) {
+	keys := testPGPKeys(t)
+
+	message := newTestMessage(map[string]string{
+		CONF_PGP_KEYRING: keys.keyring,
+		CONF_SIGN:        "pgp",
+	})
+
+	envelope, err := prepareEnvelope(message)
+	require.Nil(t, err)
+
+	mediaType, params, parts := multipartParts(t, envelope.Data)
+	assert.Equal(t, "multipart/signed", mediaType)
+	assert.Equal(t, "pgp-sha256", params["micalg"])
+	assert.Equal(t, "application/pgp-signature", params["protocol"])
+	require.Equal(t, 2, len(parts))
+
+	assert.Contains(t, parts[0], "Content-Type: text/plain")
+	assert.Contains(t, string(envelope.Data), "Subject: Test\r\n")
+
+	_, body := splitHeader([]byte(parts[1]))
+
+	_, err = openpgp.CheckArmoredDetachedSignature(openpgp.EntityList{keys.sender},
+		strings.NewReader(parts[0]), bytes.NewReader(body), nil)
+	assert.Nil(t, err)
+}
+
+func TestPGPProtect_Encrypt(t *testing.T) {
+	keys := testPGPKeys(t)
+
+	message := newTestMessage(map[string]string{
+		CONF_PGP_KEYRING: keys.keyring,
+		CONF_ENCRYPT:     "pgp",
+		CONF_SIGN:        "pgp",
+	})
+	message.Body = []string{"The password is 'snail'."}
+
+	envelope, err := prepareEnvelope(message)
+	require.Nil(t, err)
+	assert.NotContains(t, string(envelope.Data), "password")
+
+	mediaType, params, parts := multipartParts(t, envelope.Data)
+	assert.Equal(t, "multipart/encrypted", mediaType)
+	assert.Equal(t, "application/pgp-encrypted", params["protocol"])
+	require.Equal(t, 2, len(parts))
+	assert.Contains(t, parts[0], "Version: 1")
+
+	_, body := splitHeader([]byte(parts[1]))
+
+	block, err := armor.Decode(bytes.NewReader(body))
+	require.Nil(t, err)
+
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{keys.recipient, keys.sender}, nil, nil)
+	require.Nil(t, err)
+
+	plaintext, err := ioutil.ReadAll(md.UnverifiedBody)
+	require.Nil(t, err)
+
+	assert.True(t, md.IsSigned)
+	assert.Nil(t, md.SignatureError)
+	assert.Contains(t, string(plaintext), "Content-Type: text/plain")
+	assert.Contains(t, string(plaintext), "The password is 'snail'.")
+}
+
+func TestVerifyPGP(t *testing.T) {
+	keys := testPGPKeys(t)
+
+	message := newTestMessage(map[string]string{CONF_PGP_KEYRING: keys.keyring})
+	assert.Nil(t, verifyPGP(message))
+
+	message.Conf.Set(CONF_ENCRYPT, "pgp")
+	message.Conf.Set(CONF_SIGN, "pgp")
+	assert.Nil(t, verifyPGP(message))
+
+	message.Conf.Set(CONF_CC, "someone@example.com, other@example.com")
+	errs := verifyPGP(message)
+	require.Equal(t, 1, len(errs))
+	assert.Equal(t, "no PGP key for someone@example.com, other@example.com", errs[0].Error())
+
+	message.Conf.Set(CONF_FROM, "other@example.com")
+	assert.Equal(t, 2, len(verifyPGP(message)))
+
+	message.Conf.Set(CONF_SIGN, "gpg")
+	assert.NotNil(t, verifyPGP(message))
+}
@@ -0,0 +1,343 @@
+/* proxy.go: reach SMTP servers through a SOCKS5 or HTTP proxy
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	. "github.com/githubert/lettersnail/common"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Opens connections, either directly or through a proxy. Gives up when the
+// context is done.
+type dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Create the dialer for CONF_PROXY. Without a proxy, connections are opened
+// directly.
+func newDialer(message *Message) (dialer, error) {
+	value := message.Get(CONF_PROXY)
+
+	if value == "" {
+		return &net.Dialer{}, nil
+	}
+
+	u, err := url.Parse(value)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid '%s': %s", CONF_PROXY, err.Error())
+	}
+
+	proxy := &proxyDialer{forward: &net.Dialer{}, user: u.User}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		proxy.addr = withDefaultPort(u.Host, "1080")
+		return &socks5Dialer{proxy, u.Scheme == "socks5"}, nil
+	case "http":
+		proxy.addr = withDefaultPort(u.Host, "80")
+		return &connectDialer{proxy}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported '%s' scheme '%s', use socks5:// or http://", CONF_PROXY, u.Scheme)
+}
+
+func withDefaultPort(host string, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+
+	return net.JoinHostPort(host, port)
+}
+
+// What both kinds of proxies need: where the proxy is, how to reach it, and
+// the credentials for it.
+type proxyDialer struct {
+	addr    string
+	forward dialer
+	user    *url.Userinfo
+}
+
+// Open the connection to the proxy, and run `handshake` on it to reach `addr`.
+// The handshake has to be done before the deadline of `ctx`.
+func (p *proxyDialer) dial(ctx context.Context, network string, addr string, handshake func(net.Conn, string) (net.Conn, error)) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("proxy: network %s is not supported", network)
+	}
+
+	conn, err := p.forward.DialContext(ctx, "tcp", p.addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	proxied, err := handshake(conn, addr)
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return proxied, nil
+}
+
+// SOCKS version 5 (RFC 1928), with username/password authentication
+// (RFC 1929). Host names are resolved by the proxy, unless `resolve` is set.
+type socks5Dialer struct {
+	*proxyDialer
+	resolve bool
+}
+
+// SOCKS5 replies that are likely to go away.
+var temporarySOCKSReplies = map[byte]bool{
+	0x01: true, // general failure
+	0x03: true, // network unreachable
+	0x04: true, // host unreachable
+	0x05: true, // connection refused
+	0x06: true, // TTL expired
+}
+
+func (d *socks5Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.resolve {
+		host, port, err := net.SplitHostPort(addr)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if net.ParseIP(host) == nil {
+			ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+
+			if err != nil {
+				return nil, err
+			}
+
+			addr = net.JoinHostPort(ips[0].String(), port)
+		}
+	}
+
+	return d.dial(ctx, network, addr, d.handshake)
+}
+
+func (d *socks5Dialer) handshake(conn net.Conn, addr string) (net.Conn, error) {
+	host, portText, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(portText)
+
+	if err != nil {
+		return nil, fmt.Errorf("socks5: invalid port %s", portText)
+	}
+
+	methods := []byte{0x00}
+
+	if d.user != nil {
+		methods = []byte{0x02}
+	}
+
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 2)
+
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+
+	if reply[0] != 0x05 || reply[1] != methods[0] {
+		return nil, fmt.Errorf("socks5: proxy %s refuses the authentication method", d.addr)
+	}
+
+	if d.user != nil {
+		password, _ := d.user.Password()
+		user := d.user.Username()
+
+		if len(user) > 255 || len(password) > 255 {
+			return nil, fmt.Errorf("socks5: user name or password too long")
+		}
+
+		request := []byte{0x01, byte(len(user))}
+		request = append(request, user...)
+		request = append(request, byte(len(password)))
+		request = append(request, password...)
+
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return nil, err
+		}
+
+		// The version of the sub-negotiation, see RFC 1929.
+		if reply[0] != 0x01 {
+			return nil, fmt.Errorf("socks5: proxy %s answers the authentication with version %d", d.addr, reply[0])
+		}
+
+		if reply[1] != 0x00 {
+			return nil, fmt.Errorf("socks5: proxy %s refuses the credentials", d.addr)
+		}
+	}
+
+	request := []byte{0x05, 0x01, 0x00}
+
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("socks5: host name too long")
+		}
+
+		request = append(request, 0x03, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, 0x01)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, 0x04)
+		request = append(request, ip...)
+	}
+
+	request = append(request, byte(port>>8), byte(port))
+
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 4)
+
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+
+	if header[1] != 0x00 {
+		err := fmt.Errorf("socks5: proxy %s cannot connect to %s (reply %d)", d.addr, addr, header[1])
+
+		if temporarySOCKSReplies[header[1]] {
+			return nil, temporary(err)
+		}
+
+		return nil, err
+	}
+
+	// Skip the address the proxy connected from.
+	var skip int
+
+	switch header[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		length := make([]byte, 1)
+
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+
+		skip = int(length[0])
+	default:
+		return nil, fmt.Errorf("socks5: invalid reply from proxy %s", d.addr)
+	}
+
+	if _, err := io.ReadFull(conn, make([]byte, skip+2)); err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// HTTP proxies, using the CONNECT method (RFC 7231, section 4.3.6).
+type connectDialer struct {
+	*proxyDialer
+}
+
+func (d *connectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.dial(ctx, network, addr, d.handshake)
+}
+
+func (d *connectDialer) handshake(conn net.Conn, addr string) (net.Conn, error) {
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+
+	if d.user != nil {
+		password, _ := d.user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.user.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := request.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+
+	response, err := http.ReadResponse(reader, request)
+
+	if err != nil {
+		return nil, err
+	}
+
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		err := fmt.Errorf("http proxy %s cannot connect to %s: %s", d.addr, addr, response.Status)
+
+		switch response.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return nil, temporary(err)
+		}
+
+		return nil, err
+	}
+
+	// The SMTP server speaks first, so its greeting may already be in
+	// the buffer.
+	return &bufferedConn{conn, reader}, nil
+}
+
+// A connection with some of its input already read into a buffer.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,347 @@
+/* proxy_test.go: tests for SOCKS5 and HTTP proxies
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	. "github.com/githubert/lettersnail/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A stand-in for a proxy, speaking either SOCKS5 or HTTP CONNECT, and
+// relaying connections to wherever the client asks for.
+type fakeProxy struct {
+	listener net.Listener
+	http     bool
+
+	// Credentials the client has to present, if set.
+	user     string
+	password string
+
+	// Sent as version of the authentication reply instead of 0x01, if set.
+	authVersion byte
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func newFakeProxy(t *testing.T, http bool) *fakeProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	p := &fakeProxy{listener: l, http: http}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go p.handle(conn)
+		}
+	}()
+
+	return p
+}
+
+func (p *fakeProxy) URL() string {
+	scheme := "socks5"
+
+	if p.http {
+		scheme = "http"
+	}
+
+	if p.user != "" {
+		return fmt.Sprintf("%s://%s:%s@%s", scheme, p.user, p.password, p.listener.Addr())
+	}
+
+	return fmt.Sprintf("%s://%s", scheme, p.listener.Addr())
+}
+
+// The addresses clients asked to be connected to.
+func (p *fakeProxy) Targets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]string{}, p.targets...)
+}
+
+func (p *fakeProxy) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var target string
+	var ok bool
+	var client io.Reader
+
+	if p.http {
+		target, client, ok = p.handleHTTP(conn)
+	} else {
+		target, ok = p.handleSOCKS5(conn)
+		client = conn
+	}
+
+	if !ok {
+		return
+	}
+
+	p.mu.Lock()
+	p.targets = append(p.targets, target)
+	p.mu.Unlock()
+
+	upstream, err := net.Dial("tcp", target)
+
+	if err != nil {
+		if p.http {
+			fmt.Fprint(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		} else {
+			conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		}
+
+		return
+	}
+
+	defer upstream.Close()
+
+	if p.http {
+		fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	} else {
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+	}
+
+	go io.Copy(upstream, client)
+	io.Copy(conn, upstream)
+}
+
+func (p *fakeProxy) handleHTTP(conn net.Conn) (string, io.Reader, bool) {
+	reader := bufio.NewReader(conn)
+
+	request, err := http.ReadRequest(reader)
+
+	if err != nil || request.Method != http.MethodConnect {
+		return "", nil, false
+	}
+
+	if p.user != "" {
+		expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(p.user+":"+p.password))
+
+		if request.Header.Get("Proxy-Authorization") != expected {
+			fmt.Fprint(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return "", nil, false
+		}
+	}
+
+	return request.Host, reader, true
+}
+
+func (p *fakeProxy) handleSOCKS5(conn net.Conn) (string, bool) {
+	header := make([]byte, 2)
+
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", false
+	}
+
+	methods := make([]byte, header[1])
+
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", false
+	}
+
+	if p.user == "" {
+		conn.Write([]byte{0x05, 0x00})
+	} else {
+		conn.Write([]byte{0x05, 0x02})
+
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return "", false
+		}
+
+		user := make([]byte, header[1])
+		io.ReadFull(conn, user)
+
+		length := make([]byte, 1)
+		io.ReadFull(conn, length)
+
+		password := make([]byte, length[0])
+		io.ReadFull(conn, password)
+
+		if string(user) != p.user || string(password) != p.password {
+			conn.Write([]byte{0x01, 0x01})
+			return "", false
+		}
+
+		if p.authVersion != 0 {
+			conn.Write([]byte{p.authVersion, 0x00})
+			return "", false
+		}
+
+		conn.Write([]byte{0x01, 0x00})
+	}
+
+	request := make([]byte, 4)
+
+	if _, err := io.ReadFull(conn, request); err != nil || request[1] != 0x01 {
+		return "", false
+	}
+
+	var host string
+
+	switch request[3] {
+	case 0x01, 0x04:
+		ip := make([]byte, net.IPv4len)
+
+		if request[3] == 0x04 {
+			ip = make([]byte, net.IPv6len)
+		}
+
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 0x03:
+		length := make([]byte, 1)
+		io.ReadFull(conn, length)
+
+		name := make([]byte, length[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		return "", false
+	}
+
+	port := make([]byte, 2)
+
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", false
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), true
+}
+
+func TestDeliverSMTP_Proxy(t *testing.T) {
+	startTLS := newFakeSMTPServer(t, false, true)
+	defer startTLS.Close()
+
+	implicit := newFakeSMTPServer(t, true, false)
+	defer implicit.Close()
+
+	for _, useHTTP := range []bool{false, true} {
+		proxy := newFakeProxy(t, useHTTP)
+		proxy.user, proxy.password = "me", "p@ss"
+
+		for _, test := range []struct {
+			server *fakeSMTPServer
+			mode   string
+		}{
+			{startTLS, TLS_STARTTLS},
+			{implicit, TLS_IMPLICIT},
+		} {
+			message := newTestMessage(test.server.settings())
+			message.Conf.Set(CONF_SMTP_TLS, test.mode)
+			message.Conf.Set(CONF_PROXY, proxy.URL())
+
+			before := len(test.server.Mails())
+
+			require.Nil(t, trySend(message), proxy.URL())
+
+			mails := test.server.Mails()
+			require.Equal(t, before+1, len(mails))
+			assert.True(t, mails[len(mails)-1].tls)
+		}
+
+		assert.Equal(t, []string{startTLS.Addr(), implicit.Addr()}, proxy.Targets())
+	}
+}
+
+func TestDeliverSMTP_ProxyRefused(t *testing.T) {
+	server := newFakeSMTPServer(t, false, false)
+	defer server.Close()
+
+	for _, useHTTP := range []bool{false, true} {
+		proxy := newFakeProxy(t, useHTTP)
+		proxy.user, proxy.password = "me", "secret"
+
+		// Wrong credentials.
+		message := newTestMessage(server.settings())
+		proxy.password = "wrong"
+		message.Conf.Set(CONF_PROXY, proxy.URL())
+		proxy.password = "secret"
+
+		err := trySend(message)
+		require.NotNil(t, err)
+		assert.False(t, isTemporary(err))
+
+		// A reply to the credentials that is not RFC 1929.
+		if !useHTTP {
+			proxy.authVersion = 0x05
+			message.Conf.Set(CONF_PROXY, proxy.URL())
+
+			err = trySend(message)
+			require.NotNil(t, err)
+			assert.Contains(t, err.Error(), "version 5")
+
+			proxy.authVersion = 0
+		}
+
+		// The proxy cannot reach the server.
+		message.Conf.Set(CONF_PROXY, proxy.URL())
+		message.Conf.Set(CONF_SMTP_SERVER, closedAddr(t))
+
+		err = trySend(message)
+		require.NotNil(t, err)
+		assert.True(t, isTemporary(err), err.Error())
+	}
+
+	message := newTestMessage(server.settings())
+	message.Conf.Set(CONF_PROXY, "ftp://proxy.example.com")
+	assert.NotNil(t, trySend(message))
+}
+
+func TestSOCKS5Dialer_Resolve(t *testing.T) {
+	proxy := newFakeProxy(t, false)
+	_, port, _ := net.SplitHostPort(closedAddr(t))
+
+	for _, url := range []string{proxy.URL(), strings.Replace(proxy.URL(), "socks5", "socks5h", 1)} {
+		d, err := newDialer(newTestMessage(map[string]string{CONF_PROXY: url}))
+		require.Nil(t, err)
+
+		// Nobody listens there, only the request to the proxy matters.
+		d.DialContext(context.Background(), "tcp", "localhost:"+port)
+	}
+
+	targets := proxy.Targets()
+	require.Equal(t, 2, len(targets))
+
+	// socks5:// sends the address, socks5h:// leaves resolving to the
+	// proxy.
+	host, _, err := net.SplitHostPort(targets[0])
+	require.Nil(t, err)
+	assert.True(t, net.ParseIP(host).IsLoopback(), targets[0])
+	assert.Equal(t, "localhost:"+port, targets[1])
+}
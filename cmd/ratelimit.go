@@ -0,0 +1,236 @@
+/* ratelimit.go: limit how many messages are sent
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	. "github.com/githubert/lettersnail/common"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Deliveries are recorded in this file of the working directory, so that
+// limits spanning more than one run can be enforced.
+const JOURNAL_FILE = "sent.journal"
+
+// The longest period a limit looks back on. Older entries of the journal are
+// dropped.
+const JOURNAL_PERIOD = 24 * time.Hour
+
+// A delivery, as recorded in the journal.
+type journalEntry struct {
+	time       time.Time
+	recipients []string
+}
+
+// Limits on the number of messages sent, to stay below what the provider
+// accepts. A limit of 0 means there is none.
+type rateLimits struct {
+	perRun             int
+	perMinute          int
+	perRecipientPerDay int
+
+	// Messages sent in this run.
+	sent int
+
+	journal []journalEntry
+	path    string
+}
+
+// Read the limits from the configuration, and the journal from the working
+// directory if it is needed.
+func newRateLimits(conf *Configuration, now time.Time) (*rateLimits, error) {
+	l := &rateLimits{path: filepath.Join(conf.Get(CONF_WORKDIR), JOURNAL_FILE)}
+
+	for key, limit := range map[string]*int{
+		CONF_MAX_PER_RUN:               &l.perRun,
+		CONF_MAX_PER_MINUTE:            &l.perMinute,
+		CONF_MAX_PER_RECIPIENT_PER_DAY: &l.perRecipientPerDay,
+	} {
+		value, err := conf.GetInt(key)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if value < 0 {
+			return nil, fmt.Errorf("'%s' must not be negative", key)
+		}
+
+		*limit = value
+	}
+
+	if l.perMinute > 0 || l.perRecipientPerDay > 0 {
+		if err := l.load(now); err != nil {
+			return nil, fmt.Errorf("reading %s: %s", JOURNAL_FILE, err.Error())
+		}
+	}
+
+	return l, nil
+}
+
+// Load the journal, dropping entries that are too old to matter.
+func (l *rateLimits) load(now time.Time) error {
+	f, err := os.Open(l.path)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	expired := false
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) != 2 {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, fields[0])
+
+		if err != nil {
+			continue
+		}
+
+		if now.Sub(t) >= JOURNAL_PERIOD {
+			expired = true
+			continue
+		}
+
+		l.journal = append(l.journal, journalEntry{t, strings.Split(fields[1], ",")})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if expired {
+		return l.rewrite()
+	}
+
+	return nil
+}
+
+func (e journalEntry) String() string {
+	return e.time.UTC().Format(time.RFC3339) + " " + strings.Join(e.recipients, ",") + "\n"
+}
+
+func (l *rateLimits) rewrite() error {
+	var content strings.Builder
+
+	for _, entry := range l.journal {
+		content.WriteString(entry.String())
+	}
+
+	return writeFileAtomic(l.path, []byte(content.String()))
+}
+
+// Whether any of the limits is set.
+func (l *rateLimits) active() bool {
+	return l.perRun > 0 || l.perMinute > 0 || l.perRecipientPerDay > 0
+}
+
+// Check whether a message to the given recipients may be sent now. If not,
+// the reason is returned.
+func (l *rateLimits) holdBack(now time.Time, recipients []string) string {
+	if l.perRun > 0 && l.sent >= l.perRun {
+		return fmt.Sprintf("%d messages sent in this run ('%s')", l.sent, CONF_MAX_PER_RUN)
+	}
+
+	if l.perMinute > 0 {
+		count := 0
+
+		for _, entry := range l.journal {
+			if now.Sub(entry.time) < time.Minute {
+				count++
+			}
+		}
+
+		if count >= l.perMinute {
+			return fmt.Sprintf("%d messages sent in the last minute ('%s')", count, CONF_MAX_PER_MINUTE)
+		}
+	}
+
+	if l.perRecipientPerDay > 0 {
+		for _, recipient := range recipients {
+			count := 0
+
+			for _, entry := range l.journal {
+				if now.Sub(entry.time) < JOURNAL_PERIOD && containsFold(entry.recipients, recipient) {
+					count++
+				}
+			}
+
+			if count >= l.perRecipientPerDay {
+				return fmt.Sprintf("%d messages sent to %s in the last day ('%s')", count, recipient, CONF_MAX_PER_RECIPIENT_PER_DAY)
+			}
+		}
+	}
+
+	return ""
+}
+
+// Count a delivery. Unless `dryRun` is set, it is added to the journal file.
+func (l *rateLimits) record(now time.Time, recipients []string, dryRun bool) error {
+	l.sent++
+
+	if l.perMinute == 0 && l.perRecipientPerDay == 0 {
+		return nil
+	}
+
+	entry := journalEntry{now, recipients}
+	l.journal = append(l.journal, entry)
+
+	if dryRun {
+		return nil
+	}
+
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteString(entry.String())
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+
+	return false
+}
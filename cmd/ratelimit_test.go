@@ -0,0 +1,164 @@
+/* ratelimit_test.go: tests for the rate limits
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	. "github.com/githubert/lettersnail/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRateLimits_Journal(t *testing.T) {
+	workdir := testWorkdir(t)
+	journal := filepath.Join(workdir, JOURNAL_FILE)
+
+	require.Nil(t, ioutil.WriteFile(journal, []byte(
+		"2020-01-01T10:00:00Z you@example.com\n"+
+			"2020-01-02T11:59:30Z you@example.com,other@example.com\n"+
+			"garbage\n"), 0600))
+
+	conf := testConfiguration(workdir, "memory")
+	conf.Set(CONF_MAX_PER_MINUTE, "2")
+	conf.Set(CONF_MAX_PER_RECIPIENT_PER_DAY, "1")
+
+	now := time.Date(2020, 1, 2, 12, 0, 0, 0, time.UTC)
+
+	limits, err := newRateLimits(conf, now)
+	require.Nil(t, err)
+
+	// The entry of the day before is gone.
+	content, err := ioutil.ReadFile(journal)
+	require.Nil(t, err)
+	assert.Equal(t, "2020-01-02T11:59:30Z you@example.com,other@example.com\n", string(content))
+
+	assert.Equal(t, "1 messages sent to OTHER@example.com in the last day ('max-per-recipient-per-day')",
+		limits.holdBack(now, []string{"someone@example.com", "OTHER@example.com"}))
+	assert.Equal(t, "", limits.holdBack(now, []string{"someone@example.com"}))
+
+	require.Nil(t, limits.record(now, []string{"someone@example.com"}, false))
+
+	assert.Equal(t, "2 messages sent in the last minute ('max-per-minute')",
+		limits.holdBack(now, []string{"third@example.com"}))
+	assert.Equal(t, "", limits.holdBack(now.Add(31*time.Second), []string{"third@example.com"}))
+
+	content, err = ioutil.ReadFile(journal)
+	require.Nil(t, err)
+	assert.Contains(t, string(content), "2020-01-02T12:00:00Z someone@example.com\n")
+
+	limits, err = newRateLimits(testConfiguration(workdir, "memory"), now)
+	require.Nil(t, err)
+	assert.False(t, limits.active())
+
+	conf.Set(CONF_MAX_PER_RUN, "-1")
+	_, err = newRateLimits(conf, now)
+	assert.NotNil(t, err)
+}
+
+func TestProcessMessage_RateLimits(t *testing.T) {
+	transport := useMemoryTransport(t)
+	workdir := testWorkdir(t)
+
+	conf := testConfiguration(workdir, "memory")
+	conf.Set(CONF_MAX_PER_RUN, "2")
+	conf.Set(CONF_MAX_PER_RECIPIENT_PER_DAY, "1")
+
+	now := time.Now()
+
+	limits, err := newRateLimits(conf, now)
+	require.Nil(t, err)
+
+	r := newRunner(now, false, false)
+	r.limits = limits
+
+	for _, m := range []struct{ name, to string }{
+		{"1.msg", "you@example.com"},
+		{"2.msg", "you@example.com"},
+		{"3.msg", "other@example.com"},
+		{"4.msg", "third@example.com"},
+	} {
+		message := todoMessage(t, workdir, m.name, conf,
+			"from: me@example.com",
+			"to: "+m.to,
+			"subject: Test",
+			"date: 2000-01-01",
+			"",
+			"Hello.")
+
+		require.Nil(t, r.processMessage(message))
+	}
+
+	require.Equal(t, 2, len(transport.envelopes))
+
+	assertExists(t, filepath.Join(workdir, DIR_DONE, "1.msg"))
+	assertExists(t, filepath.Join(workdir, DIR_TODO, "2.msg"))
+	assertExists(t, filepath.Join(workdir, DIR_DONE, "3.msg"))
+	assertExists(t, filepath.Join(workdir, DIR_TODO, "4.msg"))
+
+	// The next run still knows about the first message.
+	limits, err = newRateLimits(conf, now.Add(time.Hour))
+	require.Nil(t, err)
+	assert.NotEqual(t, "", limits.holdBack(now.Add(time.Hour), []string{"you@example.com"}))
+	assert.Equal(t, "", limits.holdBack(now.Add(time.Hour), []string{"third@example.com"}))
+}
+
+func TestProcessMessage_RateLimitsClock(t *testing.T) {
+	transport := useMemoryTransport(t)
+	workdir := testWorkdir(t)
+
+	conf := testConfiguration(workdir, "memory")
+	conf.Set(CONF_MAX_PER_MINUTE, "1")
+
+	// The run starts well before the messages are sent.
+	start := time.Date(2020, 1, 2, 11, 59, 0, 0, time.UTC)
+
+	limits, err := newRateLimits(conf, start)
+	require.Nil(t, err)
+
+	r := newRunner(start, false, false)
+	r.limits = limits
+
+	for _, m := range []struct {
+		name string
+		at   time.Time
+	}{
+		{"1.msg", start.Add(50 * time.Second)},
+		// Less than a minute after the first one, though more than a
+		// minute after the start of the run.
+		{"2.msg", start.Add(80 * time.Second)},
+		{"3.msg", start.Add(111 * time.Second)},
+	} {
+		at := m.at
+		r.clock = func() time.Time { return at }
+
+		require.Nil(t, r.processMessage(todoMessage(t, workdir, m.name, conf)))
+	}
+
+	require.Equal(t, 2, len(transport.envelopes))
+
+	assertExists(t, filepath.Join(workdir, DIR_DONE, "1.msg"))
+	assertExists(t, filepath.Join(workdir, DIR_TODO, "2.msg"))
+	assertExists(t, filepath.Join(workdir, DIR_DONE, "3.msg"))
+
+	content, err := ioutil.ReadFile(filepath.Join(workdir, JOURNAL_FILE))
+	require.Nil(t, err)
+	assert.Equal(t, "2020-01-02T11:59:50Z you@example.com\n2020-01-02T12:00:51Z you@example.com\n", string(content))
+}
@@ -0,0 +1,184 @@
+/* retry.go: move failed messages back into the queue
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"fmt"
+	"github.com/docopt/docopt.go"
+	. "github.com/githubert/lettersnail/common"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var usageRetry =
+// tag::retry[]
+`
+Usage:
+  lettersnail retry [--check] [--now] (--all | NAME...)
+
+Options:
+  --help   Show this help.
+  --all    Requeue all messages in the errors/ folder.
+  --check  Check the messages first, and leave those with problems alone.
+  --now    Send the requeued messages right away, regardless of their date.
+
+NAME is the file name of a message in errors/, the ".msg" may be left out.
+` // end::retry[]
+
+func Retry(argv []string, conf *Configuration) {
+	args, _ := docopt.Parse(usageRetry, argv, true, "", false)
+
+	check := args["--check"].(bool)
+	now := args["--now"].(bool)
+
+	workdir := conf.Get(CONF_WORKDIR)
+	names := args["NAME"].([]string)
+
+	if args["--all"].(bool) {
+		names = []string{}
+
+		for _, message := range NewMessagesFromDirectory(filepath.Join(workdir, DIR_ERRORS)) {
+			names = append(names, message.Name)
+		}
+
+		sort.Strings(names)
+	}
+
+	ok := true
+	requeued := []Message{}
+
+	for _, name := range names {
+		message, err := requeueMessage(name, conf, check)
+
+		if err != nil {
+			fmt.Printf("Not requeuing %s: %s\n", name, err.Error())
+			ok = false
+			continue
+		}
+
+		fmt.Printf("Requeued %s.\n", message.Name)
+		requeued = append(requeued, message)
+	}
+
+	if now && len(requeued) > 0 {
+		names := []string{}
+
+		for _, message := range requeued {
+			names = append(names, message.Name)
+		}
+
+		r := newRunner(time.Now(), false, true)
+		r.force = true
+
+		if !runMessages(r, runConfiguration(conf), names) {
+			fmt.Println("There were errors when verifying one or more messages.")
+			ok = false
+		}
+
+		r.close()
+	}
+
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// The configuration `run` would use: with the [run] section of the INI
+// instead of [retry], so that messages are sent the same way. The command
+// line and the working directory stay as they are.
+func runConfiguration(conf *Configuration) *Configuration {
+	runConf := NewConfiguration()
+	runConf.MergeWith(conf)
+	runConf.MergeWithIni(CMD_RUN)
+
+	for _, key := range conf.Keys() {
+		if key == CONF_WORKDIR || conf.Source(key) == SOURCE_COMMAND_LINE {
+			runConf.SetFrom(key, conf.Get(key), conf.Source(key))
+		}
+	}
+
+	return runConf
+}
+
+// Move the message `name` from errors/ back to todo/, along with its log. The
+// log is kept, and later attempts are added to it. If `check` is true, a
+// message with problems stays where it is.
+func requeueMessage(name string, conf *Configuration, check bool) (Message, error) {
+	name = filepath.Base(name)
+
+	if !strings.HasSuffix(name, ".msg") {
+		name += ".msg"
+	}
+
+	workdir := conf.Get(CONF_WORKDIR)
+
+	message, err := NewMessageFromFile(filepath.Join(workdir, DIR_ERRORS, name))
+
+	if err != nil {
+		return Message{}, err
+	}
+
+	message.MergeWith(conf)
+
+	if check {
+		if errs := messageProblems(&message); errs != nil {
+			problems := []string{}
+
+			for _, err := range errs {
+				problems = append(problems, err.Error())
+			}
+
+			return Message{}, fmt.Errorf("%s", strings.Join(problems, "; "))
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(workdir, DIR_TODO, name)); err == nil {
+		return Message{}, fmt.Errorf("%s/%s already exists", DIR_TODO, name)
+	}
+
+	// Left-overs of an earlier attempt would delay the message.
+	if err := removeRetryState(&message); err != nil {
+		return Message{}, err
+	}
+
+	if err := moveFiles(workdir, name, DIR_ERRORS, DIR_TODO); err != nil {
+		return Message{}, err
+	}
+
+	// The recipients that accepted the message already do not get it again.
+	err = os.Rename(retryStatePathIn(&message, DIR_ERRORS), retryStatePath(&message))
+
+	if err != nil && !os.IsNotExist(err) {
+		return Message{}, err
+	}
+
+	// The originals in todo/ may have been changed or removed meanwhile.
+	// Changes are kept, removed files are brought back.
+	if err := copyAttachments(&message, DIR_TODO, false); err != nil {
+		return Message{}, err
+	}
+
+	message.Dir = filepath.Join(workdir, DIR_TODO)
+
+	logMessage(message, DIR_TODO, fmt.Sprintf("Requeued at %s.", time.Now().Format(DATETIME_FORMAT)))
+
+	return message, nil
+}
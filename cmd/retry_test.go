@@ -0,0 +1,204 @@
+/* retry_test.go: unit tests for requeuing failed messages
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"fmt"
+	. "github.com/githubert/lettersnail/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequeueMessage(t *testing.T) {
+	transport := useMemoryTransport(t)
+	transport.err = fmt.Errorf("no pigeons left")
+
+	workdir := testWorkdir(t)
+	conf := testConfiguration(workdir, "memory")
+
+	message := todoMessage(t, workdir, "1.msg", conf)
+	require.Nil(t, newRunner(time.Now(), false, false).processMessage(message))
+
+	transport.err = nil
+
+	// A message of the same name is waiting in todo/ already.
+	todo := filepath.Join(workdir, DIR_TODO, "1.msg")
+	require.Nil(t, ioutil.WriteFile(todo, []byte("subject: Other\n"), 0666))
+
+	_, err := requeueMessage("1", conf, false)
+	assert.NotNil(t, err)
+	require.Nil(t, os.Remove(todo))
+
+	message, err = requeueMessage("1", conf, true)
+	require.Nil(t, err)
+
+	assertExists(t, filepath.Join(workdir, DIR_TODO, "1.log"))
+
+	_, err = os.Stat(filepath.Join(workdir, DIR_ERRORS, "1.log"))
+	assert.True(t, os.IsNotExist(err))
+
+	// A second requeue finds nothing in errors/.
+	_, err = requeueMessage("1.msg", conf, false)
+	assert.NotNil(t, err)
+
+	require.Nil(t, newRunner(time.Now(), false, false).processMessage(message))
+
+	// The log tells the whole story.
+	log, err := ioutil.ReadFile(filepath.Join(workdir, DIR_DONE, "1.log"))
+	require.Nil(t, err)
+
+	content := string(log)
+	assert.True(t, strings.Index(content, "no pigeons left") < strings.Index(content, "Requeued at"))
+	assert.True(t, strings.Index(content, "Requeued at") < strings.Index(content, "Kept in memory."))
+}
+
+func TestRequeueMessage_Accepted(t *testing.T) {
+	server := newFakeSMTPServer(t, false, false)
+	server.greylist = "someone@example.com"
+	defer server.Close()
+
+	workdir := testWorkdir(t)
+
+	conf := partialConfiguration(workdir, server)
+	conf.Set(CONF_RETRY_LIMIT, "0")
+
+	message := todoMessage(t, workdir, "1.msg", conf)
+	require.Nil(t, newRunner(time.Now(), false, false).processMessage(message))
+
+	assertExists(t, filepath.Join(workdir, DIR_ERRORS, "1.msg"))
+
+	// The recipient that accepted the message does not get it again.
+	server.greylist = ""
+
+	message, err := requeueMessage("1", conf, false)
+	require.Nil(t, err)
+	require.Nil(t, newRunner(time.Now(), false, false).processMessage(message))
+
+	mails := server.Mails()
+	require.Equal(t, 2, len(mails))
+	assert.Equal(t, []string{"you@example.com"}, mails[0].to)
+	assert.Equal(t, []string{"someone@example.com"}, mails[1].to)
+
+	assert.Contains(t, readLog(t, workdir, DIR_DONE, "1.msg"), "  Accepted earlier: you@example.com\n")
+
+	_, err = os.Stat(retryStatePath(&message))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRequeueMessage_Check(t *testing.T) {
+	workdir := testWorkdir(t)
+	conf := testConfiguration(workdir, "memory")
+
+	// Somebody broke the message while it was sitting in errors/.
+	path := filepath.Join(workdir, DIR_ERRORS, "1.msg")
+	require.Nil(t, ioutil.WriteFile(path, []byte("to: you@example.com\n\nHello.\n"), 0666))
+
+	_, err := requeueMessage("1", conf, true)
+	assert.NotNil(t, err)
+	assertExists(t, path)
+
+	_, err = requeueMessage("1", conf, false)
+	assert.Nil(t, err)
+	assertExists(t, filepath.Join(workdir, DIR_TODO, "1.msg"))
+}
+
+func TestRequeueMessage_CheckAttachments(t *testing.T) {
+	workdir := testWorkdir(t)
+	conf := testConfiguration(workdir, "memory")
+
+	// The attachment was lost, the message is fine otherwise.
+	path := filepath.Join(workdir, DIR_ERRORS, "1.msg")
+	require.Nil(t, newTestMessage(map[string]string{CONF_ATTACH: "report.pdf"}).WriteToFile(path))
+
+	_, err := requeueMessage("1", conf, true)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "cannot attach report.pdf")
+	assertExists(t, path)
+}
+
+func TestRunConfiguration(t *testing.T) {
+	workdir := testWorkdir(t)
+	iniFile := filepath.Join(workdir, "lettersnail.ini")
+
+	require.Nil(t, ioutil.WriteFile(iniFile, []byte(`
+	[default]
+	workdir = /somewhere/else
+
+	[run]
+	transport = memory
+	bcc = archive@example.com
+	max-per-run = 1
+
+	[retry]
+	bcc = nobody@example.com
+	`), 0600))
+
+	// As set up by main() for `retry --workdir ...`.
+	conf := NewConfiguration()
+	conf.Set(CONF_CONFIG_FILENAME, iniFile)
+	conf.MergeWithIni("retry")
+	conf.SetFrom(CONF_WORKDIR, workdir, SOURCE_COMMAND_LINE)
+
+	runConf := runConfiguration(conf)
+
+	assert.Equal(t, "memory", runConf.Get(CONF_TRANSPORT))
+	assert.Equal(t, "archive@example.com", runConf.Get(CONF_BCC))
+	assert.Equal(t, "1", runConf.Get(CONF_MAX_PER_RUN))
+	assert.Equal(t, workdir, runConf.Get(CONF_WORKDIR))
+
+	// The configuration of `retry` itself is left alone.
+	assert.Equal(t, "nobody@example.com", conf.Get(CONF_BCC))
+}
+
+func TestRunMessages_Names(t *testing.T) {
+	transport := useMemoryTransport(t)
+	workdir := testWorkdir(t)
+
+	conf := testConfiguration(workdir, "memory")
+	conf.Set(CONF_MAX_PER_RUN, "1")
+
+	for _, name := range []string{"1.msg", "2.msg", "3.msg"} {
+		todoMessage(t, workdir, name, conf,
+			"from: me@example.com",
+			"to: you@example.com",
+			"subject: Test",
+			"date: 2100-01-01",
+			"",
+			"Hello.")
+	}
+
+	// As for `retry --now`: the date does not matter, but only the given
+	// messages are sent, and the limits still apply.
+	r := newRunner(time.Now(), false, false)
+	r.force = true
+	defer r.close()
+
+	require.True(t, runMessages(r, conf, []string{"2.msg", "3.msg"}))
+
+	assert.Equal(t, 1, len(transport.envelopes))
+	assertExists(t, filepath.Join(workdir, DIR_TODO, "1.msg"))
+	assertExists(t, filepath.Join(workdir, DIR_DONE, "2.msg"))
+	assertExists(t, filepath.Join(workdir, DIR_TODO, "3.msg"))
+	assert.Equal(t, runStats{sent: 1, heldBack: 1}, r.stats)
+}
@@ -18,7 +18,9 @@
 package cmd
 
 import (
-	"crypto/tls"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"github.com/docopt/docopt.go"
 	. "github.com/githubert/lettersnail/common"
@@ -27,10 +29,19 @@ import (
 	"net/textproto"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 )
 
+// Supported values for CONF_PARTIAL_FAILURE, what to do when some of the
+// recipients were rejected.
+const (
+	PARTIAL_DELIVER        = "deliver"
+	PARTIAL_FAIL           = "fail"
+	PARTIAL_RETRY_REJECTED = "retry-rejected"
+)
+
 var usageRun =
 // tag::run[]
 `
@@ -49,106 +60,353 @@ Options:
   --not-after=TIME   Not after TIME. (default: 23:59)
   --server=HOST      SMTP hostname. (default: localhost)
   --port=PORT        SMTP port. (default: 587)
+  --tls=MODE         One of starttls, starttls-optional, implicit or none.
+                     (default: starttls-optional)
   --verbose          Report on successfully sent messages.
   --dry-run          Do not send the message.
   --insecure         Accept any TLS certificate.
+  --transport=NAME   How to deliver messages. (default: smtp)
+  --account=NAME     Use the settings of the [account NAME] INI section.
+  --max-per-run=N    Send at most N messages, the oldest first.
+  --run-timeout=DUR  Stop sending after DUR, like "10m". Messages not
+                     attempted by then stay in todo/.
 ` // end::run[]
 
 func Run(argv []string, conf *Configuration) {
 	args, _ := docopt.Parse(usageRun, argv, true, "", false)
 	conf.MergeWithDocOptArgs(CMD_RUN, &args)
 
-	verbose := args["--verbose"].(bool)
-	dryRun := args["--dry-run"].(bool)
-	insecure := args["--insecure"].(bool)
+	r := newRunner(time.Now(), args["--dry-run"].(bool), args["--verbose"].(bool))
+	ok := runMessages(r, conf, nil)
+	r.close()
 
-	now := time.Now()
+	if !ok {
+		// FIXME: This suggests that other messages were not sent, but they were....
+		fmt.Println("There were errors when verifying one or more messages.")
+		fmt.Println("Please run 'lettersnail check'")
+		os.Exit(1)
+	}
+}
 
-	notBeforeTime, err := time.Parse(TIME_FORMAT, conf.Get(CONF_NOT_BEFORE))
+// Send the messages in todo/ that are due, within the quiet period and the
+// limits of `conf`. If `names` is given, only these messages are considered.
+// A runner with `force` set ignores the quiet period, as it does the date of
+// the messages. Returns false if a message failed verification.
+func runMessages(r *runner, conf *Configuration, names []string) bool {
+	now := r.now
 
-	if err != nil {
-		fmt.Printf("Failed parsing not-before time: %s\n", err.Error())
-		return
+	if !r.force {
+		notBeforeTime, err := time.Parse(TIME_FORMAT, conf.Get(CONF_NOT_BEFORE))
+
+		if err != nil {
+			fmt.Printf("Failed parsing not-before time: %s\n", err.Error())
+			return true
+		}
+
+		notAfterTime, err := time.Parse(TIME_FORMAT, conf.Get(CONF_NOT_AFTER))
+
+		if err != nil {
+			fmt.Printf("Failed parsing not-after time: %s\n", err.Error())
+			return true
+		}
+
+		notBefore := buildTime(now, notBeforeTime.Hour(), notBeforeTime.Minute(), true)
+		notAfter := buildTime(now, notAfterTime.Hour(), notAfterTime.Minute(), false)
+
+		// Return if we are in some quiet period.
+		if now.After(notAfter) || now.Before(notBefore) {
+			return true
+		}
 	}
 
-	notAfterTime, err := time.Parse(TIME_FORMAT, conf.Get(CONF_NOT_AFTER))
+	limits, err := newRateLimits(conf, now)
 
 	if err != nil {
-		fmt.Printf("Failed parsing not-after time: %s\n", err.Error())
-		return
+		fmt.Printf("Failed reading the rate limits: %s\n", err.Error())
+		return true
 	}
 
-	notBefore := buildTime(now, notBeforeTime.Hour(), notBeforeTime.Minute(), true)
-	notAfter := buildTime(now, notAfterTime.Hour(), notAfterTime.Minute(), false)
+	runTimeout, err := conf.GetDuration(CONF_RUN_TIMEOUT)
 
-	// Return if we are in some quiet period.
-	if now.After(notAfter) || now.Before(notBefore) {
-		return
+	if err != nil || runTimeout < 0 {
+		fmt.Printf("Failed parsing run-timeout: %s\n", conf.Get(CONF_RUN_TIMEOUT))
+		return true
 	}
 
 	messages := NewMessagesFromDirectory(filepath.Join(conf.Get(CONF_WORKDIR), DIR_TODO))
 
-	verificationError := false
+	if names != nil {
+		wanted := map[string]bool{}
+
+		for _, name := range names {
+			wanted[name] = true
+		}
+
+		selected := Messages{}
+
+		for _, message := range messages {
+			if wanted[message.Name] {
+				selected = append(selected, message)
+			}
+		}
+
+		messages = selected
+	}
+
+	// When the limits do not allow to send everything, the most overdue
+	// messages go first.
+	sort.Stable(messages)
+
+	ok := true
+
+	r.limits = limits
+
+	if runTimeout > 0 {
+		ctx, cancel := context.WithDeadline(context.Background(), now.Add(runTimeout))
+		defer cancel()
+
+		r.ctx = ctx
+	}
 
 	for _, message := range messages {
-		message.Conf.MergeWith(conf)
-		err := processMessage(message, now, dryRun, insecure, verbose)
+		message.MergeWith(conf)
+		err := r.processMessage(message)
 
 		if err != nil {
-			verificationError = true
+			ok = false
 			continue
 		}
 	}
 
-	if verificationError {
-		// FIXME: This suggests that other messages were not sent, but they were....
-		fmt.Println("There were errors when verifying one or more messages.")
-		fmt.Println("Please run 'lettersnail check'")
-		os.Exit(1)
+	if r.ctx.Err() != nil {
+		fmt.Printf("Stopped after %s ('%s'). %s\n", runTimeout, CONF_RUN_TIMEOUT, r.stats)
+	} else if r.verbose {
+		fmt.Println(r.stats)
+	}
+
+	return ok
+}
+
+// State of a single run, shared by all messages.
+type runner struct {
+	now     time.Time
+	dryRun  bool
+	verbose bool
+
+	// Send messages regardless of their date, and of earlier failed
+	// attempts.
+	force bool
+
+	// Transports are shared by messages with the same delivery settings, so
+	// that, for example, a single SMTP session is used for all of them.
+	transports map[string]Transport
+
+	// Messages beyond these limits stay in todo/ for a later run. Without
+	// limits, everything due is sent.
+	limits *rateLimits
+
+	// The time a message is actually sent, which may be well after `now`.
+	// The rate limits are checked and recorded with it.
+	clock func() time.Time
+
+	// Once this is done, the remaining messages are left for a later run.
+	ctx context.Context
+
+	stats runStats
+}
+
+// What became of the messages that were due in a run.
+type runStats struct {
+	sent         int
+	failed       int
+	retrying     int
+	heldBack     int
+	notAttempted int
+}
+
+func (s runStats) String() string {
+	text := fmt.Sprintf("%d sent, %d failed, %d to be retried, %d held back", s.sent, s.failed, s.retrying, s.heldBack)
+
+	if s.notAttempted > 0 {
+		text += fmt.Sprintf(", %d not attempted and left in %s/", s.notAttempted, DIR_TODO)
 	}
+
+	return text + "."
 }
 
-func processMessage(message Message, now time.Time, dryRun, insecure, verbose bool) error {
+func newRunner(now time.Time, dryRun, verbose bool) *runner {
+	return &runner{
+		now:        now,
+		dryRun:     dryRun,
+		verbose:    verbose,
+		transports: map[string]Transport{},
+		clock:      time.Now,
+		ctx:        context.Background(),
+	}
+}
+
+// Close all transports opened during the run.
+func (r *runner) close() {
+	for key, transport := range r.transports {
+		if err := transport.Close(); err != nil {
+			fmt.Printf("Error when closing %s: %s\n", transport, err.Error())
+		}
+
+		delete(r.transports, key)
+	}
+}
+
+// Return the transport for the given message, reusing an existing one if
+// possible.
+func (r *runner) transport(message *Message) (Transport, error) {
+	key := transportKey(message)
+
+	if transport, ok := r.transports[key]; ok {
+		return transport, nil
+	}
+
+	transport, err := newTransport(message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r.transports[key] = transport
+
+	return transport, nil
+}
+
+func (r *runner) processMessage(message Message) error {
 	if errs := message.Verify(); errs != nil {
 		return fmt.Errorf("Message %s failed verification.", message.Name)
 	}
 
+	policy, err := partialFailurePolicy(&message)
+
+	if err != nil {
+		return fmt.Errorf("Message %s failed verification.", message.Name)
+	}
+
 	date, err := ParseTime(message.Get("date"))
 
 	if err != nil {
 		return err
 	}
 
-	if !now.After(date) {
+	if !r.force && !r.now.After(date) {
 		return nil
 	}
 
-	sendErr := sendMessage(message, dryRun, insecure)
+	state, err := loadRetryState(&message)
+
+	if err != nil {
+		fmt.Printf("Error when reading the retry state of message %s: %s\n", message.Name, err.Error())
+		return nil
+	}
+
+	// An earlier attempt failed, and it is too early to try again.
+	if !r.force && r.now.Before(state.NextAttempt) {
+		return nil
+	}
+
+	// Out of time, the message is left alone for the next run.
+	if r.ctx.Err() != nil {
+		r.stats.notAttempted++
+		return nil
+	}
+
+	recipients, limited := r.holdBack(&message)
+
+	if limited {
+		r.stats.heldBack++
+		return nil
+	}
+
+	delivery, sendErr := r.sendMessage(message, state.done())
+
+	// Running out of time says nothing about the message, it will be tried
+	// again.
+	if sendErr != nil && r.ctx.Err() != nil && !isTemporary(sendErr) {
+		sendErr = temporary(sendErr)
+	}
+
+	if sendErr == nil && r.limits != nil {
+		if err := r.limits.record(r.clock(), recipients, r.dryRun); err != nil {
+			fmt.Printf("Error when writing %s: %s\n", JOURNAL_FILE, err.Error())
+		}
+	}
+
+	report := recipientReport(state, delivery)
+
+	if sendErr == nil {
+		sendErr = partialFailure(policy, state, delivery)
+	}
 
 	if sendErr != nil {
-		if !dryRun {
-			err := moveMessage(message, DIR_ERRORS)
+		if r.dryRun {
+			fmt.Printf("Error when sending message %s: %s\n", message.Name, sendErr.Error())
+			return nil
+		}
 
-			if err != nil {
-				fmt.Printf("Error when moving message %s: %s\n", message.Name, err.Error())
-			}
+		if r.retryLater(&message, state, sendErr) {
+			r.stats.retrying++
+			return nil
+		}
+
+		r.stats.failed++
+
+		if err := keepAccepted(&message, state); err != nil {
+			fmt.Printf("Error when removing the retry state of message %s: %s\n", message.Name, err.Error())
+		}
+
+		err := moveMessage(message, DIR_ERRORS)
 
-			logMessage(message, DIR_ERRORS, sendErr.Error())
+		if err != nil {
+			fmt.Printf("Error when moving message %s: %s\n", message.Name, err.Error())
+		}
+
+		if err := copyAttachments(&message, DIR_ERRORS, true); err != nil {
+			fmt.Printf("Error when copying the attachments of message %s: %s\n", message.Name, err.Error())
 		}
 
+		logText := sendErr.Error()
+
+		if state.Attempts > 0 {
+			logText = fmt.Sprintf("Giving up after %d attempts. %s", state.Attempts+1, logText)
+		}
+
+		logMessage(message, DIR_ERRORS, logText+report)
+
 		fmt.Printf("Error when sending message %s: %s\n", message.Name, sendErr.Error())
 	} else {
-		if !dryRun {
+		r.stats.sent++
+
+		if !r.dryRun {
+			if err := removeRetryState(&message); err != nil {
+				fmt.Printf("Error when removing the retry state of message %s: %s\n", message.Name, err.Error())
+			}
+
 			err := moveMessage(message, DIR_DONE)
 
 			if err != nil {
 				fmt.Printf("Error when moving message %s: %s\n", message.Name, err.Error())
 			}
 
-			logMessage(message, DIR_DONE, "Successfully delivered.")
+			if err := copyAttachments(&message, DIR_DONE, true); err != nil {
+				fmt.Printf("Error when copying the attachments of message %s: %s\n", message.Name, err.Error())
+			}
+
+			_, id := messageID(&message)
+			logMessage(message, DIR_DONE, fmt.Sprintf("Successfully delivered as %s. %s%s", id, delivery.Info, report))
 		}
 
-		if verbose {
+		if rejected := delivery.Rejected(); len(rejected) > 0 {
+			fmt.Printf("Message %s delivered, but %d of its recipients were rejected:\n", message.Name, len(rejected))
+
+			for _, status := range rejected {
+				fmt.Printf("  %s: %s\n", status.Address, status.Err.Error())
+			}
+		} else if r.verbose {
 			fmt.Printf("Message %s delivered.\n", message.Name)
 		}
 	}
@@ -156,11 +414,159 @@ func processMessage(message Message, now time.Time, dryRun, insecure, verbose bo
 	return nil // TODO: what about errors that are not verification errors?
 }
 
+// Determine what to do with the given message, when some of its recipients
+// are rejected.
+func partialFailurePolicy(message *Message) (string, error) {
+	policy := strings.ToLower(message.Get(CONF_PARTIAL_FAILURE))
+
+	switch policy {
+	case "":
+		return PARTIAL_RETRY_REJECTED, nil
+	case PARTIAL_DELIVER, PARTIAL_FAIL, PARTIAL_RETRY_REJECTED:
+		return policy, nil
+	}
+
+	return "", fmt.Errorf("unknown '%s' policy '%s'", CONF_PARTIAL_FAILURE, policy)
+}
+
+// Apply the policy to a delivery where some of the recipients were rejected.
+// Unless the message counts as delivered, an error is returned. With
+// PARTIAL_RETRY_REJECTED, the recipients that are done are noted in `state`,
+// so that only those rejected temporarily are tried again.
+func partialFailure(policy string, state *retryState, delivery *Delivery) error {
+	rejected := delivery.Rejected()
+
+	if len(rejected) == 0 {
+		return nil
+	}
+
+	err := fmt.Errorf("%d of %d recipients rejected", len(rejected), len(delivery.Recipients))
+
+	switch policy {
+	case PARTIAL_FAIL:
+		return err
+	case PARTIAL_RETRY_REJECTED:
+		retry := false
+
+		for _, status := range delivery.Recipients {
+			switch {
+			case status.Err == nil:
+				state.Accepted = append(state.Accepted, status.Address)
+			case isTemporary(status.Err):
+				retry = true
+			default:
+				state.Rejected = append(state.Rejected, status.Address)
+			}
+		}
+
+		if retry {
+			return temporary(err)
+		}
+	}
+
+	return nil
+}
+
+// List what became of each recipient, for the log. This includes those that
+// were done with in earlier attempts.
+func recipientReport(state *retryState, delivery *Delivery) string {
+	var report strings.Builder
+
+	for _, address := range state.Accepted {
+		fmt.Fprintf(&report, "\nAccepted earlier: %s", address)
+	}
+
+	for _, address := range state.Rejected {
+		fmt.Fprintf(&report, "\nRejected earlier: %s", address)
+	}
+
+	if delivery != nil {
+		for _, status := range delivery.Recipients {
+			if status.Err == nil {
+				fmt.Fprintf(&report, "\nAccepted: %s", status.Address)
+			} else {
+				fmt.Fprintf(&report, "\nRejected: %s: %s", status.Address, status.Err.Error())
+			}
+		}
+	}
+
+	return report.String()
+}
+
+// Check the rate limits for the given message. If it has to wait for a later
+// run, true is returned. Otherwise its recipients are returned, to be recorded
+// once it was sent.
+func (r *runner) holdBack(message *Message) ([]string, bool) {
+	if r.limits == nil || !r.limits.active() {
+		return nil, false
+	}
+
+	e, err := prepareEmail(message)
+
+	if err != nil {
+		// Sending will fail and report the problem.
+		return nil, false
+	}
+
+	_, recipients, err := envelopeAddresses(e)
+
+	if err != nil {
+		return nil, false
+	}
+
+	if reason := r.limits.holdBack(r.clock(), recipients); reason != "" {
+		if r.verbose {
+			fmt.Printf("Message %s held back: %s.\n", message.Name, reason)
+		}
+
+		return nil, true
+	}
+
+	return recipients, false
+}
+
+// Keep the message in todo/ for another attempt, if the failure is temporary
+// and the message has not been tried too often yet. Returns false if the
+// failure is final.
+func (r *runner) retryLater(message *Message, state *retryState, sendErr error) bool {
+	if !isTemporary(sendErr) {
+		return false
+	}
+
+	limit, delay, err := retryPolicy(message)
+
+	if err != nil {
+		fmt.Printf("Error in the retry settings of message %s: %s\n", message.Name, err.Error())
+		return false
+	}
+
+	if state.Attempts >= limit {
+		return false
+	}
+
+	state.Attempts++
+	state.NextAttempt = r.now.Add(backoff(delay, state.Attempts))
+	state.LastError = sendErr.Error()
+
+	if err := state.save(message); err != nil {
+		fmt.Printf("Error when saving the retry state of message %s: %s\n", message.Name, err.Error())
+		return false
+	}
+
+	if r.verbose {
+		fmt.Printf("Temporary error when sending message %s, trying again after %s: %s\n",
+			message.Name, state.NextAttempt.Format(DATETIME_FORMAT), sendErr.Error())
+	}
+
+	return true
+}
+
+// Write a log file for the message. Logs of earlier attempts, for messages
+// that were requeued with `lettersnail retry`, are kept above the new one.
 func logMessage(message Message, dir string, logMessage string) {
-	dstDir := filepath.Join(message.Get(CONF_WORKDIR), dir)
-	filename := filepath.Join(dstDir, message.Name[:len(message.Name)-len(".msg")]+".log")
+	filename := filepath.Join(message.Get(CONF_WORKDIR), dir, logName(message.Name))
 
-	f, err := os.Create(filename)
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
 
 	if err != nil {
 		fmt.Printf("Error when creating log file: %s\n", err.Error())
@@ -169,8 +575,14 @@ func logMessage(message Message, dir string, logMessage string) {
 
 	defer f.Close()
 
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		f.WriteString("\n----\n\n")
+	}
+
 	f.WriteString("Log message:\n")
-	f.WriteString(fmt.Sprintf("  %s\n", logMessage))
+	for _, s := range strings.Split(logMessage, "\n") {
+		f.WriteString(fmt.Sprintf("  %s\n", s))
+	}
 	f.WriteString("\n")
 
 	f.WriteString("\nConfiguration:\n")
@@ -249,44 +661,124 @@ func prepareEmail(message *Message) (*email.Email, error) {
 		e.Bcc = bcc
 	}
 
-	e.Text = []byte(strings.Join(message.Body, "\n"))
+	if err := setBody(message, e); err != nil {
+		return nil, err
+	}
+
+	if err := attachFiles(message, e); err != nil {
+		return nil, err
+	}
+
+	id, messageID := messageID(message)
+	e.Headers.Set("Message-Id", messageID)
+
+	if traceHeaders(message) {
+		e.Headers.Set("X-Lettersnail-Name", message.Name)
+		e.Headers.Set("X-Lettersnail-Id", id)
+	}
 
 	return e, nil
 }
 
-// Send the given message, unless `dryRun` is true. Use `insecure` to work
-// around things like self-signed certificates.
-func sendMessage(message Message, dryRun bool, insecure bool) error {
-	e, err := prepareEmail(&message)
+// Derive the identifier of a message from its file name and its date, and
+// build a Message-ID from it. Sending the same message again, for example
+// after `lettersnail retry`, results in the same Message-ID, so that
+// receivers can spot duplicates.
+func messageID(message *Message) (string, string) {
+	sum := sha256.Sum256([]byte(message.Name + "\n" + message.Get(CONF_DATE)))
+	id := hex.EncodeToString(sum[:16])
+
+	domain := "lettersnail.invalid"
+
+	if from, err := mail.ParseAddress(message.Get(CONF_FROM)); err == nil {
+		domain = strings.ToLower(from.Address[strings.LastIndex(from.Address, "@")+1:])
+	}
+
+	return id, "<" + id + ".lettersnail@" + domain + ">"
+}
+
+// Whether to add the X-Lettersnail-* header fields, which they are unless
+// CONF_TRACE_HEADERS is turned off.
+func traceHeaders(message *Message) bool {
+	on, err := message.Conf.GetBool(CONF_TRACE_HEADERS)
+
+	return message.Get(CONF_TRACE_HEADERS) == "" || (on && err == nil)
+}
+
+// Send the given message through its transport, unless this is a dry run.
+// Recipients in `done` are left out, as they got the message already.
+func (r *runner) sendMessage(message Message, done []string) (*Delivery, error) {
+	envelope, err := prepareEnvelope(&message)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	smtpServer := message.Get(CONF_SMTP_SERVER) + ":" + message.Get(CONF_SMTP_PORT)
+	envelope = envelope.without(done)
 
-	if dryRun {
-		fmt.Printf("Skip sending message %s through %s.\n", message.Name, smtpServer)
-		return nil
+	if len(envelope.Recipients) == 0 {
+		return nil, fmt.Errorf("no recipients left")
 	}
 
-	if insecure {
-		return e.SendWithTLS(smtpServer, nil, &tls.Config{InsecureSkipVerify: true})
-	} else {
-		return e.Send(smtpServer, nil)
+	transport, err := r.transport(&message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if r.dryRun {
+		fmt.Printf("Skip sending message %s through %s.\n", message.Name, transport)
+		return &Delivery{}, nil
 	}
+
+	delivery, err := transport.Deliver(r.ctx, envelope)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Without word on the recipients, all of them were accepted.
+	if len(delivery.Recipients) == 0 {
+		for _, recipient := range envelope.Recipients {
+			delivery.Recipients = append(delivery.Recipients, RecipientStatus{Address: recipient})
+		}
+	}
+
+	return delivery, nil
+}
+
+// Name of the log file belonging to the message file `name`.
+func logName(name string) string {
+	return strings.TrimSuffix(name, ".msg") + ".log"
 }
 
-// Move the given message to a folder relative to the working directory.
+// Move the given message to a folder relative to the working directory. A log
+// of earlier attempts is moved along.
 func moveMessage(message Message, relative string) error {
-	todo := filepath.Join(message.Get(CONF_WORKDIR), DIR_TODO)
-	to := filepath.Join(message.Get(CONF_WORKDIR), relative)
+	return moveFiles(message.Get(CONF_WORKDIR), message.Name, DIR_TODO, relative)
+}
 
+// Move the message file `name`, and its log if there is one, from one folder
+// of the working directory to another.
+func moveFiles(workdir string, name string, from string, to string) error {
 	// FIXME: BUG: This will overwrite existing messages. Look at create.go:nextFreeFilename()
 	//             for ideas on how to resolve this. We could try to use a similar approach.
 	//             `foo.msg` to `foo.1.msg` and `foo.1.log`.
 
-	return os.Rename(filepath.Join(todo, message.Name), filepath.Join(to, message.Name))
+	err := os.Rename(filepath.Join(workdir, from, name), filepath.Join(workdir, to, name))
+
+	if err != nil {
+		return err
+	}
+
+	log := logName(name)
+	err = os.Rename(filepath.Join(workdir, from, log), filepath.Join(workdir, to, log))
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
 }
 
 // Build a time.Time from some given base time. If floor is true, seconds will
@@ -18,7 +18,11 @@
 package cmd
 
 import (
+	. "github.com/githubert/lettersnail/common"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -37,3 +41,123 @@ func TestBuildTime(t *testing.T) {
 
 	assert.Equal(t, t2.Second(), 59)
 }
+
+func TestPrepareEmail_Headers(t *testing.T) {
+	message := newTestMessage(map[string]string{CONF_FROM: "Me <me@Example.com>"})
+
+	e, err := prepareEmail(message)
+	require.Nil(t, err)
+
+	id, first := messageID(message)
+	assert.Equal(t, "<"+id+".lettersnail@example.com>", first)
+	assert.Equal(t, first, e.Headers.Get("Message-Id"))
+	assert.Equal(t, "test.msg", e.Headers.Get("X-Lettersnail-Name"))
+	assert.Equal(t, id, e.Headers.Get("X-Lettersnail-Id"))
+
+	// The same message always gets the same Message-ID.
+	again, err := prepareEmail(message)
+	require.Nil(t, err)
+	assert.Equal(t, first, again.Headers.Get("Message-Id"))
+
+	// Another date makes it another message.
+	message.Conf.Set(CONF_DATE, "2000-01-02")
+	_, other := messageID(message)
+	assert.NotEqual(t, first, other)
+
+	message.Conf.Set(CONF_TRACE_HEADERS, "false")
+
+	e, err = prepareEmail(message)
+	require.Nil(t, err)
+	assert.Equal(t, other, e.Headers.Get("Message-Id"))
+	assert.Equal(t, "", e.Headers.Get("X-Lettersnail-Name"))
+	assert.Equal(t, "", e.Headers.Get("X-Lettersnail-Id"))
+}
+
+// A run that sends to someone@example.com as well, through `server`.
+func partialConfiguration(workdir string, server *fakeSMTPServer) *Configuration {
+	conf := testConfiguration(workdir, TRANSPORT_SMTP)
+	conf.Set(CONF_SMTP_SERVER, server.Addr())
+	conf.Set(CONF_SMTP_TLS, TLS_NONE)
+	conf.Set(CONF_CC, "someone@example.com")
+
+	return conf
+}
+
+func readLog(t *testing.T, workdir string, dir string, name string) string {
+	log, err := ioutil.ReadFile(filepath.Join(workdir, dir, logName(name)))
+	require.Nil(t, err)
+
+	return string(log)
+}
+
+func TestProcessMessage_PartialFailure(t *testing.T) {
+	server := newFakeSMTPServer(t, false, false)
+	defer server.Close()
+
+	workdir := testWorkdir(t)
+	conf := partialConfiguration(workdir, server)
+
+	for _, test := range []struct {
+		name, policy, reject, greylist, dir string
+	}{
+		// The message counts as delivered.
+		{"1.msg", "", "someone@example.com", "", DIR_DONE},
+		// The message counts as failed, although it went out to some.
+		{"2.msg", PARTIAL_FAIL, "someone@example.com", "", DIR_ERRORS},
+		// Only on request, a greylisted recipient is given up on.
+		{"3.msg", PARTIAL_DELIVER, "", "someone@example.com", DIR_DONE},
+	} {
+		server.reject, server.greylist = test.reject, test.greylist
+		conf.Set(CONF_PARTIAL_FAILURE, test.policy)
+
+		require.Nil(t, newRunner(time.Now(), false, false).processMessage(todoMessage(t, workdir, test.name, conf)))
+
+		log := readLog(t, workdir, test.dir, test.name)
+		assert.Contains(t, log, "  Accepted: you@example.com\n", test.name)
+		assert.Contains(t, log, "  Rejected: someone@example.com: ", test.name)
+	}
+
+	assert.Contains(t, readLog(t, workdir, DIR_ERRORS, "2.msg"), "1 of 2 recipients rejected")
+
+	conf.Set(CONF_PARTIAL_FAILURE, "sometimes")
+	assert.NotNil(t, newRunner(time.Now(), false, false).processMessage(todoMessage(t, workdir, "4.msg", conf)))
+}
+
+func TestProcessMessage_RetryRejected(t *testing.T) {
+	// Greylisted recipients are not given up on by default.
+	for _, policy := range []string{PARTIAL_RETRY_REJECTED, ""} {
+		server := newFakeSMTPServer(t, false, false)
+		server.greylist = "someone@example.com"
+
+		workdir := testWorkdir(t)
+
+		conf := partialConfiguration(workdir, server)
+		conf.Set(CONF_PARTIAL_FAILURE, policy)
+
+		message := todoMessage(t, workdir, "1.msg", conf)
+
+		now := time.Now()
+		require.Nil(t, newRunner(now, false, false).processMessage(message))
+
+		state, err := loadRetryState(&message)
+		require.Nil(t, err)
+		assert.Equal(t, 1, state.Attempts)
+		assert.Equal(t, []string{"you@example.com"}, state.Accepted)
+
+		// The next attempt only goes to the recipient that was rejected.
+		server.greylist = ""
+
+		require.Nil(t, newRunner(now.Add(DEFAULT_RETRY_DELAY), false, false).processMessage(message))
+
+		mails := server.Mails()
+		require.Equal(t, 2, len(mails))
+		assert.Equal(t, []string{"you@example.com"}, mails[0].to)
+		assert.Equal(t, []string{"someone@example.com"}, mails[1].to)
+
+		log := readLog(t, workdir, DIR_DONE, "1.msg")
+		assert.Contains(t, log, "  Accepted earlier: you@example.com\n")
+		assert.Contains(t, log, "  Accepted: someone@example.com\n")
+
+		server.Close()
+	}
+}
@@ -0,0 +1,96 @@
+/* sendmail.go: deliver messages through a sendmail compatible command
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	. "github.com/githubert/lettersnail/common"
+	"os/exec"
+	"strings"
+)
+
+const DEFAULT_SENDMAIL_COMMAND = "/usr/sbin/sendmail"
+
+// Exit code of sendmail for temporary failures, see sysexits.h.
+const EX_TEMPFAIL = 75
+
+// Pipes messages into a sendmail compatible command, like sendmail itself,
+// msmtp or the sendmail wrappers of Postfix and Exim.
+type sendmailTransport struct {
+	command []string
+}
+
+func newSendmailTransport(message *Message) (Transport, error) {
+	command := strings.Fields(message.Get(CONF_SENDMAIL_COMMAND))
+
+	if len(command) == 0 {
+		command = []string{DEFAULT_SENDMAIL_COMMAND}
+	}
+
+	return &sendmailTransport{command: command}, nil
+}
+
+func (t *sendmailTransport) Close() error {
+	return nil
+}
+
+func (t *sendmailTransport) String() string {
+	return fmt.Sprintf("sendmail: %s", strings.Join(t.command, " "))
+}
+
+// The command gets the sender (-f) and the recipients from the envelope, so
+// Bcc recipients are included, and those done with in an earlier attempt are
+// not. A line with a single dot does not end the message (-i).
+func (t *sendmailTransport) Deliver(ctx context.Context, envelope *Envelope) (*Delivery, error) {
+	args := append(append([]string{}, t.command[1:]...), "-f", envelope.From, "-i", "--")
+	args = append(args, envelope.Recipients...)
+
+	cmd := exec.CommandContext(ctx, t.command[0], args...)
+	cmd.Stdin = bytes.NewReader(unixLineEndings(envelope.Data))
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.Stdout = &stderr
+
+	err := cmd.Run()
+	output := strings.TrimSpace(stderr.String())
+
+	if err != nil {
+		if output != "" {
+			err = fmt.Errorf("%s: %s: %s", t.command[0], err.Error(), output)
+		} else {
+			err = fmt.Errorf("%s: %s", t.command[0], err.Error())
+		}
+
+		if cmd.ProcessState != nil && cmd.ProcessState.ExitCode() == EX_TEMPFAIL {
+			err = temporary(err)
+		}
+
+		return nil, err
+	}
+
+	info := fmt.Sprintf("Handed over to %s.", t.command[0])
+
+	if output != "" {
+		info += " Output: " + output
+	}
+
+	return &Delivery{Info: info}, nil
+}
@@ -0,0 +1,103 @@
+/* sendmail_test.go: unit tests for the sendmail transport
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	. "github.com/githubert/lettersnail/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Write a shell script pretending to be sendmail. It stores its arguments and
+// the message next to itself.
+func fakeSendmail(t *testing.T, dir string, exitCode string) string {
+	script := filepath.Join(dir, "sendmail")
+
+	content := "#!/bin/sh\n" +
+		"echo \"$@\" > \"$0.args\"\n" +
+		"cat > \"$0.out\"\n" +
+		"if [ " + exitCode + " -ne 0 ]; then echo 'sendmail: no such user' >&2; fi\n" +
+		"exit " + exitCode + "\n"
+
+	require.Nil(t, ioutil.WriteFile(script, []byte(content), 0755))
+
+	return script
+}
+
+func TestSendmailTransport(t *testing.T) {
+	workdir := testWorkdir(t)
+	script := fakeSendmail(t, workdir, "0")
+
+	conf := testConfiguration(workdir, TRANSPORT_SENDMAIL)
+	conf.Set(CONF_SENDMAIL_COMMAND, script+" -a work")
+
+	message := todoMessage(t, workdir, "1.msg", conf,
+		"from: me@example.com",
+		"to: you@example.com",
+		"bcc: hidden@example.com",
+		"subject: Test",
+		"date: 2000-01-01",
+		"",
+		"Hello.")
+
+	require.Nil(t, newRunner(time.Now(), false, false).processMessage(message))
+	assertExists(t, filepath.Join(workdir, DIR_DONE, "1.msg"))
+
+	args, err := ioutil.ReadFile(script + ".args")
+	require.Nil(t, err)
+	assert.Equal(t, "-a work -f me@example.com -i -- you@example.com hidden@example.com\n", string(args))
+
+	// Line endings are those of the system.
+	out, err := ioutil.ReadFile(script + ".out")
+	require.Nil(t, err)
+	assert.NotContains(t, string(out), "hidden@example.com")
+	assert.NotContains(t, string(out), "\r\n")
+
+	// Recipients done with earlier are left out.
+	r := newRunner(time.Now(), false, false)
+	_, err = r.sendMessage(message, []string{"you@example.com"})
+	require.Nil(t, err)
+
+	args, err = ioutil.ReadFile(script + ".args")
+	require.Nil(t, err)
+	assert.Equal(t, "-a work -f me@example.com -i -- hidden@example.com\n", string(args))
+}
+
+func TestSendmailTransport_Failure(t *testing.T) {
+	err := trySend(newTestMessage(map[string]string{
+		CONF_TRANSPORT:        TRANSPORT_SENDMAIL,
+		CONF_SENDMAIL_COMMAND: fakeSendmail(t, testWorkdir(t), "67"),
+	}))
+
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "exit status 67: sendmail: no such user")
+}
+
+func TestSendmailTransport_TemporaryFailure(t *testing.T) {
+	err := trySend(newTestMessage(map[string]string{
+		CONF_TRANSPORT:        TRANSPORT_SENDMAIL,
+		CONF_SENDMAIL_COMMAND: fakeSendmail(t, testWorkdir(t), "75"),
+	}))
+
+	require.NotNil(t, err)
+	assert.True(t, isTemporary(err))
+}
@@ -0,0 +1,130 @@
+/* session.go: sessions with mail servers, kept open between messages
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+)
+
+// The protocol side of a session, like smtp.Client or lmtpClient.
+type sessionClient interface {
+	Reset() error
+	Quit() error
+	Close() error
+}
+
+// A session with a mail server, used for all messages of a run. It is reset
+// before each message, and dropped once it is in an unknown state.
+type mailSession struct {
+	client sessionClient
+	conn   *deadlineConn
+}
+
+func (s *mailSession) open(client sessionClient, conn *deadlineConn) {
+	s.client, s.conn = client, conn
+}
+
+// Make the session ready for the next message, which is sent within `ctx`.
+// Returns false if there is no session, or if it does not answer any more,
+// for example because the server closed the connection in the meantime.
+func (s *mailSession) reuse(ctx context.Context) bool {
+	if s.client == nil {
+		return false
+	}
+
+	s.conn.ctx = ctx
+
+	if err := s.client.Reset(); err != nil {
+		s.drop()
+		return false
+	}
+
+	return true
+}
+
+// Drop the session without further ado.
+func (s *mailSession) drop() {
+	if s.client != nil {
+		s.client.Close()
+		s.client = nil
+	}
+}
+
+// Drop the session after a message failed with `err`, unless the server
+// rejected it: then the session can be reset and used for the next message.
+func (s *mailSession) dropUnlessReply(err error) {
+	if err != nil && !isReply(err) {
+		s.drop()
+	}
+}
+
+// End the session. All messages were handed over already, so a server that
+// does not answer the QUIT any more is of no concern.
+func (s *mailSession) close() {
+	if s.client == nil {
+		return
+	}
+
+	// The context of the last message may be done already, but saying
+	// goodbye must not take forever either.
+	s.conn.ctx = context.Background()
+
+	if err := s.client.Quit(); err != nil {
+		s.client.Close()
+	}
+
+	s.client = nil
+}
+
+// Whether `err` is a reply of the server. Anything else, like a network
+// error, means the session is gone.
+func isReply(err error) bool {
+	var reply *textproto.Error
+
+	return errors.As(err, &reply)
+}
+
+// Announce each recipient with `rcpt`, which sends RCPT TO. The replies are
+// noted for each recipient, along with the index of those accepted. Fails if
+// the session is gone, or if all recipients were rejected.
+func announceRecipients(to []string, rcpt func(addr string) error) ([]RecipientStatus, []int, error) {
+	statuses := []RecipientStatus{}
+	accepted := []int{}
+
+	for _, addr := range to {
+		err := rcpt(addr)
+
+		if err != nil && !isReply(err) {
+			return nil, nil, err
+		}
+
+		if err == nil {
+			accepted = append(accepted, len(statuses))
+		}
+
+		statuses = append(statuses, RecipientStatus{Address: addr, Err: err})
+	}
+
+	if len(accepted) == 0 {
+		return nil, nil, allRejected(statuses)
+	}
+
+	return statuses, accepted, nil
+}
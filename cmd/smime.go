@@ -0,0 +1,388 @@
+/* smime.go: S/MIME signed and encrypted messages (RFC 8551)
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	. "github.com/githubert/lettersnail/common"
+	"go.mozilla.org/pkcs7"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Values of the smime-type parameter of application/pkcs7-mime.
+const (
+	SMIME_SIGNED_DATA    = "signed-data"
+	SMIME_ENVELOPED_DATA = "enveloped-data"
+)
+
+// pkcs7 only knows a global setting for the cipher. Nothing else uses the
+// package, so it is set once, instead of on every call of smimeEncrypt.
+func init() {
+	pkcs7.ContentEncryptionAlgorithm = pkcs7.EncryptionAlgorithmAES256CBC
+}
+
+// Determine whether the message is to be signed and/or encrypted with S/MIME.
+// Combining S/MIME with PGP is not supported.
+func smimeOptions(message *Message) (bool, bool, error) {
+	sign, err := message.Conf.GetBool(CONF_SMIME_SIGN)
+
+	if err != nil {
+		return false, false, err
+	}
+
+	encrypt, err := message.Conf.GetBool(CONF_SMIME_ENCRYPT)
+
+	if err != nil {
+		return false, false, err
+	}
+
+	if sign || encrypt {
+		for _, key := range []string{CONF_SIGN, CONF_ENCRYPT} {
+			if p, err := protection(message, key); err == nil && p != PROTECT_NONE {
+				return false, false, fmt.Errorf("'%s' cannot be combined with S/MIME", key)
+			}
+		}
+	}
+
+	return sign, encrypt, nil
+}
+
+// Load the first certificate from a PEM file.
+func loadCertificate(file string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+
+	return nil, fmt.Errorf("%s contains no certificate", file)
+}
+
+// Load an RSA or ECDSA private key from a PEM file.
+func loadSMIMEKey(file string) (crypto.PrivateKey, error) {
+	data, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+
+	if block == nil {
+		return nil, fmt.Errorf("%s contains no PEM data", file)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("%s contains neither an RSA nor an ECDSA key", file)
+}
+
+// The sender's certificate and key, from CONF_SMIME_CERT and CONF_SMIME_KEY.
+// The key has to belong to the certificate, and the certificate to the
+// sender's address.
+func smimeSigner(message *Message) (*x509.Certificate, crypto.PrivateKey, error) {
+	for _, key := range []string{CONF_SMIME_CERT, CONF_SMIME_KEY} {
+		if message.Get(key) == "" {
+			return nil, nil, fmt.Errorf("'%s' parameter is missing", key)
+		}
+	}
+
+	cert, err := loadCertificate(message.Get(CONF_SMIME_CERT))
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading '%s': %s", CONF_SMIME_CERT, err.Error())
+	}
+
+	key, err := loadSMIMEKey(message.Get(CONF_SMIME_KEY))
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading '%s': %s", CONF_SMIME_KEY, err.Error())
+	}
+
+	public, ok := key.(crypto.Signer)
+
+	if !ok || !publicKeyEqual(public.Public(), cert.PublicKey) {
+		return nil, nil, fmt.Errorf("'%s' does not belong to '%s'", CONF_SMIME_KEY, CONF_SMIME_CERT)
+	}
+
+	from, err := mail.ParseAddress(message.Get(CONF_FROM))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !certificateFor(cert, from.Address) {
+		return nil, nil, fmt.Errorf("'%s' is not issued for %s", CONF_SMIME_CERT, from.Address)
+	}
+
+	return cert, key, nil
+}
+
+func publicKeyEqual(a crypto.PublicKey, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+
+	return ok && k.Equal(b)
+}
+
+// Check whether the certificate lists the given address.
+func certificateFor(cert *x509.Certificate, address string) bool {
+	for _, a := range cert.EmailAddresses {
+		if strings.EqualFold(a, address) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The certificates of all recipients, looked up in CONF_SMIME_CERT_DIR as
+// ADDRESS.pem. All missing or expired certificates are reported at once.
+func smimeRecipients(message *Message, recipients []string) ([]*x509.Certificate, error) {
+	dir := message.Get(CONF_SMIME_CERT_DIR)
+
+	if dir == "" {
+		return nil, fmt.Errorf("'%s' parameter is missing", CONF_SMIME_CERT_DIR)
+	}
+
+	now := time.Now()
+	certs := []*x509.Certificate{}
+	problems := []string{}
+
+	for _, recipient := range recipients {
+		file := filepath.Join(dir, strings.ToLower(recipient)+".pem")
+
+		cert, err := loadCertificate(file)
+
+		if os.IsNotExist(err) {
+			problems = append(problems, fmt.Sprintf("no S/MIME certificate for %s", recipient))
+			continue
+		}
+
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+
+		if now.After(cert.NotAfter) {
+			problems = append(problems, fmt.Sprintf("the S/MIME certificate for %s has expired", recipient))
+			continue
+		}
+
+		if _, ok := cert.PublicKey.(*rsa.PublicKey); !ok {
+			problems = append(problems, fmt.Sprintf("the S/MIME certificate for %s has no RSA key", recipient))
+			continue
+		}
+
+		certs = append(certs, cert)
+	}
+
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+
+	return certs, nil
+}
+
+// Check the S/MIME settings of the given message: the sender's certificate
+// and key have to load, and there has to be a certificate for every recipient.
+func verifySMIME(message *Message) []error {
+	sign, encrypt, err := smimeOptions(message)
+
+	if err != nil {
+		return []error{err}
+	}
+
+	errs := []error{}
+
+	if sign {
+		if _, _, err := smimeSigner(message); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if encrypt {
+		e, err := prepareEmail(message)
+
+		if err != nil {
+			return append(errs, err)
+		}
+
+		_, recipients, err := envelopeAddresses(e)
+
+		if err != nil {
+			return append(errs, err)
+		}
+
+		if _, err := smimeRecipients(message, recipients); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errs
+}
+
+// Sign and/or encrypt the rendered message, as requested by CONF_SMIME_SIGN
+// and CONF_SMIME_ENCRYPT. A message that is both, is signed first. If neither
+// is set, the message is returned as it is.
+func smimeProtect(message *Message, data []byte, recipients []string) ([]byte, error) {
+	sign, encrypt, err := smimeOptions(message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !sign && !encrypt {
+		return data, nil
+	}
+
+	fields, entity := splitContent(data)
+
+	if sign {
+		cert, key, err := smimeSigner(message)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if entity, err = smimeSign(entity, cert, key); err != nil {
+			return nil, err
+		}
+	}
+
+	if encrypt {
+		certs, err := smimeRecipients(message, recipients)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if entity, err = smimeEncrypt(entity, certs); err != nil {
+			return nil, err
+		}
+	}
+
+	return entityMessage(fields, entity), nil
+}
+
+// Wrap the entity into opaque signed data, so that it survives gateways that
+// rewrite the message on the way.
+func smimeSign(entity []byte, cert *x509.Certificate, key crypto.PrivateKey) ([]byte, error) {
+	signed, err := pkcs7.NewSignedData(entity)
+
+	if err != nil {
+		return nil, err
+	}
+
+	signed.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+
+	if err := signed.AddSigner(cert, key, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, err
+	}
+
+	der, err := signed.Finish()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return pkcs7Entity(SMIME_SIGNED_DATA, der), nil
+}
+
+// Encrypt the entity for the given certificates.
+func smimeEncrypt(entity []byte, certs []*x509.Certificate) ([]byte, error) {
+	der, err := pkcs7.Encrypt(entity, certs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return pkcs7Entity(SMIME_ENVELOPED_DATA, der), nil
+}
+
+// An application/pkcs7-mime entity holding the given DER data.
+func pkcs7Entity(smimeType string, der []byte) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString("Content-Type: application/pkcs7-mime; smime-type=" + smimeType + ";\r\n\tname=\"smime.p7m\"\r\n")
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n")
+	buf.WriteString("Content-Disposition: attachment; filename=\"smime.p7m\"\r\n")
+	buf.WriteString("\r\n")
+
+	encoded := base64.StdEncoding.EncodeToString(der)
+
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+
+	buf.WriteString(encoded + "\r\n")
+
+	return buf.Bytes()
+}
+
+// The content of opaque signed data, used to show what is inside of a signed
+// message.
+func smimeSignedContent(der []byte) ([]byte, error) {
+	p7, err := pkcs7.Parse(der)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return p7.Content, nil
+}
@@ -0,0 +1,197 @@
+/* smime_test.go: tests for S/MIME signed and encrypted messages
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	. "github.com/githubert/lettersnail/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mozilla.org/pkcs7"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A self-signed certificate for `address`, and its key.
+func testSMIMECertificate(t *testing.T, address string) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(1),
+		Subject:        pkix.Name{CommonName: address},
+		EmailAddresses: []string{address},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+
+	return cert, key
+}
+
+func writePEM(t *testing.T, file string, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	require.Nil(t, ioutil.WriteFile(file, data, 0600))
+}
+
+// The certificates and keys of the sender and the recipient. The sender's are
+// written to me.pem and me.key, the recipient's certificate to the
+// certificate directory certs/.
+type smimeKeys struct {
+	sender       *x509.Certificate
+	senderKey    *rsa.PrivateKey
+	recipient    *x509.Certificate
+	recipientKey *rsa.PrivateKey
+	dir          string
+}
+
+func testSMIMEKeys(t *testing.T) *smimeKeys {
+	dir := testWorkdir(t)
+	require.Nil(t, os.Mkdir(filepath.Join(dir, "certs"), 0700))
+
+	keys := &smimeKeys{dir: dir}
+
+	keys.sender, keys.senderKey = testSMIMECertificate(t, "me@example.com")
+	keys.recipient, keys.recipientKey = testSMIMECertificate(t, "you@example.com")
+
+	writePEM(t, filepath.Join(dir, "me.pem"), "CERTIFICATE", keys.sender.Raw)
+	writePEM(t, filepath.Join(dir, "me.key"), "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(keys.senderKey))
+	writePEM(t, filepath.Join(dir, "certs", "you@example.com.pem"), "CERTIFICATE", keys.recipient.Raw)
+
+	return keys
+}
+
+// Settings that use the keys.
+func (k *smimeKeys) settings() map[string]string {
+	return map[string]string{
+		CONF_SMIME_CERT:     filepath.Join(k.dir, "me.pem"),
+		CONF_SMIME_KEY:      filepath.Join(k.dir, "me.key"),
+		CONF_SMIME_CERT_DIR: filepath.Join(k.dir, "certs"),
+	}
+}
+
+// Decode the application/pkcs7-mime body of a message.
+func pkcs7Body(t *testing.T, data []byte) (string, *pkcs7.PKCS7) {
+	header, body := splitHeader(data)
+
+	contentType := headerFields(header)["content-type"]
+
+	der, err := base64.StdEncoding.DecodeString(strings.Replace(string(body), "\r\n", "", -1))
+	require.Nil(t, err)
+
+	p7, err := pkcs7.Parse(der)
+	require.Nil(t, err)
+
+	return contentType, p7
+}
+
+func TestSMIMEProtect_Sign(t *testing.T) {
+	keys := testSMIMEKeys(t)
+
+	message := newTestMessage(keys.settings())
+	message.Conf.Set(CONF_SMIME_SIGN, "true")
+
+	envelope, err := prepareEnvelope(message)
+	require.Nil(t, err)
+	assert.Contains(t, string(envelope.Data), "Subject: Test\r\n")
+
+	contentType, p7 := pkcs7Body(t, envelope.Data)
+	assert.Contains(t, contentType, "application/pkcs7-mime; smime-type=signed-data")
+
+	assert.Nil(t, p7.Verify())
+	assert.Equal(t, keys.sender.Raw, p7.GetOnlySigner().Raw)
+	assert.Contains(t, string(p7.Content), "Content-Type: text/plain")
+	assert.Contains(t, string(p7.Content), "Hello.")
+
+	tree, err := mimeTree(envelope.Data)
+	require.Nil(t, err)
+	assert.Equal(t, []string{
+		"application/pkcs7-mime (signed-data) smime.p7m",
+		"  text/plain",
+	}, tree)
+}
+
+func TestSMIMEProtect_Encrypt(t *testing.T) {
+	keys := testSMIMEKeys(t)
+
+	message := newTestMessage(keys.settings())
+	message.Conf.Set(CONF_SMIME_SIGN, "true")
+	message.Conf.Set(CONF_SMIME_ENCRYPT, "true")
+
+	envelope, err := prepareEnvelope(message)
+	require.Nil(t, err)
+	assert.NotContains(t, string(envelope.Data), "Hello.")
+
+	tree, err := mimeTree(envelope.Data)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"application/pkcs7-mime (enveloped-data) smime.p7m"}, tree)
+
+	contentType, p7 := pkcs7Body(t, envelope.Data)
+	assert.Contains(t, contentType, "application/pkcs7-mime; smime-type=enveloped-data")
+
+	plaintext, err := p7.Decrypt(keys.recipient, keys.recipientKey)
+	require.Nil(t, err)
+
+	contentType, signed := pkcs7Body(t, plaintext)
+	assert.Contains(t, contentType, "smime-type=signed-data")
+	assert.Nil(t, signed.Verify())
+	assert.Contains(t, string(signed.Content), "Hello.")
+}
+
+func TestVerifySMIME(t *testing.T) {
+	keys := testSMIMEKeys(t)
+
+	message := newTestMessage(keys.settings())
+	assert.Nil(t, verifySMIME(message))
+
+	message.Conf.Set(CONF_SMIME_SIGN, "true")
+	message.Conf.Set(CONF_SMIME_ENCRYPT, "true")
+	assert.Nil(t, verifySMIME(message))
+
+	message.Conf.Set(CONF_CC, "someone@example.com")
+	errs := verifySMIME(message)
+	require.Equal(t, 1, len(errs))
+	assert.Equal(t, "no S/MIME certificate for someone@example.com", errs[0].Error())
+
+	message.Conf.Set(CONF_FROM, "other@example.com")
+	errs = verifySMIME(message)
+	require.Equal(t, 2, len(errs))
+	assert.Equal(t, "'smime-cert' is not issued for other@example.com", errs[0].Error())
+
+	message.Conf.Set(CONF_SIGN, "pgp")
+	errs = verifySMIME(message)
+	require.Equal(t, 1, len(errs))
+	assert.Equal(t, "'sign' cannot be combined with S/MIME", errs[0].Error())
+}
@@ -0,0 +1,460 @@
+/* smtp.go: deliver messages through an SMTP server
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	. "github.com/githubert/lettersnail/common"
+	"github.com/jordan-wright/email"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Supported values for CONF_SMTP_TLS.
+const (
+	TLS_STARTTLS          = "starttls"
+	TLS_STARTTLS_OPTIONAL = "starttls-optional"
+	TLS_IMPLICIT          = "implicit"
+	TLS_NONE              = "none"
+)
+
+// Determine the TLS mode for the given message.
+func tlsMode(message *Message) (string, error) {
+	mode := strings.ToLower(message.Get(CONF_SMTP_TLS))
+
+	switch mode {
+	case "":
+		return TLS_STARTTLS_OPTIONAL, nil
+	case TLS_STARTTLS, TLS_STARTTLS_OPTIONAL, TLS_IMPLICIT, TLS_NONE:
+		return mode, nil
+	}
+
+	return "", fmt.Errorf("unknown TLS mode '%s'", mode)
+}
+
+// An SMTP server to try, and the TLS configuration for it.
+type smtpServer struct {
+	addr   string
+	config *tls.Config
+}
+
+// Delivers messages through an SMTP server. If several servers are
+// configured, the next one is tried when a server cannot be reached or fails
+// temporarily. The session is kept open between messages until Close is
+// called.
+type smtpTransport struct {
+	servers []smtpServer
+	mode    string
+	auth    smtp.Auth
+	dialer  dialer
+
+	// The open session, and the server it is connected to.
+	session mailSession
+	current int
+
+	// How long to wait for a connection, and for the server to answer.
+	connectTimeout time.Duration
+	commandTimeout time.Duration
+}
+
+// Parse CONF_SMTP_SERVER, a comma-separated list of servers as HOST or
+// HOST:PORT, in the order they are to be tried. Like MX records, each may
+// be preceded by a priority, lower values are tried first. Servers without
+// a port use CONF_SMTP_PORT.
+func smtpServers(message *Message) ([]string, error) {
+	type entry struct {
+		priority int
+		addr     string
+	}
+
+	entries := []entry{}
+
+	for _, item := range strings.Split(message.Get(CONF_SMTP_SERVER), ",") {
+		fields := strings.Fields(item)
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		e := entry{}
+
+		switch len(fields) {
+		case 1:
+			e.addr = fields[0]
+		case 2:
+			priority, err := strconv.Atoi(fields[0])
+
+			if err != nil {
+				return nil, fmt.Errorf("invalid priority in '%s': %s", CONF_SMTP_SERVER, item)
+			}
+
+			e.priority, e.addr = priority, fields[1]
+		default:
+			return nil, fmt.Errorf("invalid entry in '%s': %s", CONF_SMTP_SERVER, item)
+		}
+
+		if _, _, err := net.SplitHostPort(e.addr); err != nil {
+			e.addr = net.JoinHostPort(strings.Trim(e.addr, "[]"), message.Get(CONF_SMTP_PORT))
+		}
+
+		entries = append(entries, e)
+	}
+
+	// Like net.Dial, an empty host means the local system.
+	if len(entries) == 0 {
+		entries = append(entries, entry{addr: net.JoinHostPort("", message.Get(CONF_SMTP_PORT))})
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].priority < entries[j].priority })
+
+	addrs := make([]string, len(entries))
+
+	for i, e := range entries {
+		addrs[i] = e.addr
+	}
+
+	return addrs, nil
+}
+
+func newSMTPTransport(message *Message) (Transport, error) {
+	auth, err := newAuth(message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	mode, err := tlsMode(message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	insecure, err := message.Conf.GetBool(CONF_SMTP_INSECURE)
+
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := smtpServers(message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dialer, err := newDialer(message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	connectTimeout, err := timeout(message, CONF_CONNECT_TIMEOUT, DEFAULT_CONNECT_TIMEOUT)
+
+	if err != nil {
+		return nil, err
+	}
+
+	commandTimeout, err := timeout(message, CONF_COMMAND_TIMEOUT, DEFAULT_COMMAND_TIMEOUT)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t := &smtpTransport{
+		mode:           mode,
+		auth:           auth,
+		dialer:         dialer,
+		connectTimeout: connectTimeout,
+		commandTimeout: commandTimeout,
+	}
+
+	for _, addr := range addrs {
+		host, _, _ := net.SplitHostPort(addr)
+
+		config, err := tlsConfig(message, host, insecure)
+
+		if err != nil {
+			return nil, err
+		}
+
+		t.servers = append(t.servers, smtpServer{addr: addr, config: config})
+	}
+
+	return t, nil
+}
+
+func (t *smtpTransport) String() string {
+	addrs := []string{}
+
+	for _, server := range t.servers {
+		addrs = append(addrs, server.addr)
+	}
+
+	return fmt.Sprintf("smtp://%s (tls: %s)", strings.Join(addrs, ", "), t.mode)
+}
+
+func (t *smtpTransport) Close() error {
+	t.session.close()
+	return nil
+}
+
+// Return a session with server `i` that is ready for the next message. An
+// existing session is reset first, if it does not answer, a new one is
+// opened.
+func (t *smtpTransport) connect(ctx context.Context, i int) (*smtp.Client, error) {
+	if t.current == i && t.session.reuse(ctx) {
+		return t.session.client.(*smtp.Client), nil
+	}
+
+	t.session.drop()
+
+	c, conn, err := t.dial(ctx, t.servers[i])
+
+	if err != nil {
+		return nil, err
+	}
+
+	t.session.open(c, conn)
+	t.current = i
+
+	return c, nil
+}
+
+// The order in which to try the servers: the one of the current session
+// first, so that a failed server is not tried again for every message.
+func (t *smtpTransport) order() []int {
+	order := []int{}
+
+	if t.session.client != nil {
+		order = append(order, t.current)
+	}
+
+	for i := range t.servers {
+		if t.session.client == nil || i != t.current {
+			order = append(order, i)
+		}
+	}
+
+	return order
+}
+
+func (t *smtpTransport) Deliver(ctx context.Context, envelope *Envelope) (*Delivery, error) {
+	failed := []string{}
+
+	var lastErr error
+
+	for _, i := range t.order() {
+		addr := t.servers[i].addr
+
+		c, err := t.connect(ctx, i)
+
+		var statuses []RecipientStatus
+
+		if err == nil {
+			statuses, err = sendSMTP(c, envelope.From, envelope.Recipients, envelope.Data)
+			t.session.dropUnlessReply(err)
+		}
+
+		if err == nil {
+			info := fmt.Sprintf("Accepted by %s.", addr)
+
+			if len(failed) > 0 {
+				info += fmt.Sprintf(" Failed before: %s.", strings.Join(failed, "; "))
+			}
+
+			return &Delivery{Info: info, Recipients: statuses}, nil
+		}
+
+		// A permanent failure would not look any different elsewhere, and
+		// without time left, there is no point in trying.
+		if len(t.servers) == 1 || !isTemporary(err) || ctx.Err() != nil {
+			return nil, err
+		}
+
+		failed = append(failed, fmt.Sprintf("%s: %s", addr, err.Error()))
+		lastErr = err
+	}
+
+	return nil, fmt.Errorf("all servers failed (%s): %w", strings.Join(failed, "; "), lastErr)
+}
+
+// Open a connection to the given server through the dialer, secure it
+// according to the TLS mode and authenticate, unless there is no `auth`.
+func (t *smtpTransport) dial(ctx context.Context, server smtpServer) (*smtp.Client, *deadlineConn, error) {
+	host, _, err := net.SplitHostPort(server.addr)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	raw, err := dialWithin(ctx, t.dialer, "tcp", server.addr, t.connectTimeout)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Everything after connecting, including the TLS handshake, is
+	// subject to the command timeout.
+	conn := &deadlineConn{Conn: raw, ctx: ctx, timeout: t.commandTimeout}
+
+	var wire net.Conn = conn
+
+	if t.mode == TLS_IMPLICIT {
+		tlsConn := tls.Client(conn, server.config)
+
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+
+		wire = tlsConn
+	}
+
+	c, err := smtp.NewClient(wire, host)
+
+	if err != nil {
+		wire.Close()
+		return nil, nil, err
+	}
+
+	if t.mode == TLS_STARTTLS || t.mode == TLS_STARTTLS_OPTIONAL {
+		ok, _ := c.Extension("STARTTLS")
+
+		if ok {
+			err = c.StartTLS(server.config)
+		} else if t.mode == TLS_STARTTLS {
+			err = fmt.Errorf("server %s does not support STARTTLS", host)
+		}
+
+		if err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+	}
+
+	if t.auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			c.Close()
+			return nil, nil, fmt.Errorf("server %s does not support authentication", host)
+		}
+
+		if err := c.Auth(t.auth); err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+	}
+
+	return c, conn, nil
+}
+
+// Determine the envelope sender and the recipients (To, Cc and Bcc) of the
+// given email.
+func envelopeAddresses(e *email.Email) (string, []string, error) {
+	from, err := mail.ParseAddress(e.From)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	to := []string{}
+
+	for _, list := range [][]string{e.To, e.Cc, e.Bcc} {
+		for _, r := range list {
+			addr, err := mail.ParseAddress(r)
+
+			if err != nil {
+				return "", nil, err
+			}
+
+			to = append(to, addr.Address)
+		}
+	}
+
+	return from.Address, to, nil
+}
+
+// Send the email through an established connection. Recipients rejected by
+// the server are skipped, the message goes to the others. Only if all of them
+// are rejected, sending fails.
+func sendSMTP(c *smtp.Client, from string, to []string, data []byte) ([]RecipientStatus, error) {
+	if err := c.Mail(from); err != nil {
+		return nil, err
+	}
+
+	statuses, _, err := announceRecipients(to, c.Rcpt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := c.Data()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+
+	return statuses, w.Close()
+}
+
+// The error when no recipient was accepted. It is temporary if any of the
+// rejections was.
+func allRejected(statuses []RecipientStatus) error {
+	if len(statuses) == 1 {
+		return statuses[0].Err
+	}
+
+	err := rejectedError{statuses}
+
+	for _, status := range statuses {
+		if isTemporary(status.Err) {
+			return temporary(err)
+		}
+	}
+
+	return err
+}
+
+// All recipients were rejected, each with its own reply.
+type rejectedError struct {
+	statuses []RecipientStatus
+}
+
+func (e rejectedError) Error() string {
+	reasons := []string{}
+
+	for _, status := range e.statuses {
+		reasons = append(reasons, fmt.Sprintf("%s: %s", status.Address, status.Err.Error()))
+	}
+
+	return "all recipients rejected: " + strings.Join(reasons, "; ")
+}
+
+// The last reply, which tells that the session is still usable.
+func (e rejectedError) Unwrap() error {
+	return e.statuses[len(e.statuses)-1].Err
+}
@@ -0,0 +1,583 @@
+/* smtp_test.go: unit tests for SMTP delivery
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	. "github.com/githubert/lettersnail/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A mail as received by fakeSMTPServer.
+type fakeMail struct {
+	from string
+	to   []string
+	data string
+	tls  bool
+}
+
+// A very small SMTP server, just enough to test the client side.
+type fakeSMTPServer struct {
+	listener net.Listener
+
+	// Certificate used for STARTTLS and implicit TLS.
+	certificate tls.Certificate
+
+	// Advertise STARTTLS.
+	startTLS bool
+
+	// Close the connection after each mail, as if the server timed out.
+	dropAfterMail bool
+
+	// Recipient refused with a permanent error.
+	reject string
+
+	// Recipient refused with a temporary error.
+	greylist string
+
+	// Refuse all mail with a temporary error.
+	tempfail bool
+
+	// Speak LMTP: one reply per recipient after DATA.
+	lmtp bool
+
+	// Recipient accepted at RCPT, but whose mailbox is full once the
+	// message arrives. Only for LMTP.
+	full string
+
+	mu          sync.Mutex
+	mails       []fakeMail
+	connections int
+	resets      int
+	quits       int
+}
+
+// Generate a self-signed certificate for 127.0.0.1.
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "lettersnail test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+
+	leaf, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// Start a fake SMTP server. If `implicit` is true, the server expects TLS
+// right from the start.
+func newFakeSMTPServer(t *testing.T, implicit bool, startTLS bool) *fakeSMTPServer {
+	s := &fakeSMTPServer{
+		certificate: testCertificate(t),
+		startTLS:    startTLS,
+	}
+
+	var err error
+
+	if implicit {
+		s.listener, err = tls.Listen("tcp", "127.0.0.1:0", s.tlsConfig())
+	} else {
+		s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+
+	require.Nil(t, err)
+
+	go s.serve()
+
+	return s
+}
+
+func (s *fakeSMTPServer) tlsConfig() *tls.Config {
+	return &tls.Config{Certificates: []tls.Certificate{s.certificate}}
+}
+
+func (s *fakeSMTPServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeSMTPServer) Close() {
+	s.listener.Close()
+}
+
+func (s *fakeSMTPServer) Mails() []fakeMail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]fakeMail{}, s.mails...)
+}
+
+// Return how many connections were accepted, and how many RSET and QUIT
+// commands were received.
+func (s *fakeSMTPServer) Counts() (int, int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.connections, s.resets, s.quits
+}
+
+func (s *fakeSMTPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	s.mu.Lock()
+	s.connections++
+	s.mu.Unlock()
+
+	_, isTLS := conn.(*tls.Conn)
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost ESMTP fake")
+
+	mail := fakeMail{}
+
+	for {
+		line, err := text.ReadLine()
+
+		if err != nil {
+			return
+		}
+
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		arg := strings.TrimSpace(line[len(verb):])
+
+		switch verb {
+		case "EHLO", "LHLO":
+			lines := []string{"localhost"}
+
+			if s.startTLS && !isTLS {
+				lines = append(lines, "STARTTLS")
+			}
+
+			for i, l := range lines {
+				sep := "-"
+
+				if i == len(lines)-1 {
+					sep = " "
+				}
+
+				text.PrintfLine("250%s%s", sep, l)
+			}
+		case "HELO":
+			text.PrintfLine("250 localhost")
+		case "STARTTLS":
+			text.PrintfLine("220 Ready to start TLS")
+			tlsConn := tls.Server(conn, s.tlsConfig())
+
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+
+			conn = tlsConn
+			text = textproto.NewConn(conn)
+			isTLS = true
+		case "MAIL":
+			if s.tempfail {
+				text.PrintfLine("451 Try again later")
+				continue
+			}
+
+			mail = fakeMail{from: strings.Trim(arg[len("FROM:"):], "<>"), tls: isTLS}
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			to := strings.Trim(arg[len("TO:"):], "<>")
+
+			if to == s.reject {
+				text.PrintfLine("550 No such user")
+				continue
+			}
+
+			if to == s.greylist {
+				text.PrintfLine("450 Greylisted, try again later")
+				continue
+			}
+
+			mail.to = append(mail.to, to)
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			data, err := text.ReadDotBytes()
+
+			if err != nil {
+				return
+			}
+
+			mail.data = string(data)
+
+			if s.lmtp {
+				s.deliverLMTP(text, mail)
+				continue
+			}
+
+			s.mu.Lock()
+			s.mails = append(s.mails, mail)
+			s.mu.Unlock()
+
+			text.PrintfLine("250 Queued")
+
+			if s.dropAfterMail {
+				return
+			}
+		case "RSET":
+			s.mu.Lock()
+			s.resets++
+			s.mu.Unlock()
+
+			text.PrintfLine("250 OK")
+		case "NOOP":
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			s.mu.Lock()
+			s.quits++
+			s.mu.Unlock()
+
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+// Store the mail for each recipient, as LMTP does, and reply for each.
+func (s *fakeSMTPServer) deliverLMTP(text *textproto.Conn, mail fakeMail) {
+	stored := fakeMail{from: mail.from, data: mail.data}
+
+	for _, to := range mail.to {
+		if to == s.full {
+			text.PrintfLine("452 4.2.2 Mailbox is full")
+			continue
+		}
+
+		stored.to = append(stored.to, to)
+		text.PrintfLine("250 2.0.0 <%s> Saved", to)
+	}
+
+	if len(stored.to) > 0 {
+		s.mu.Lock()
+		s.mails = append(s.mails, stored)
+		s.mu.Unlock()
+	}
+}
+
+// Settings for a message to the server, which has a self-signed certificate.
+func (s *fakeSMTPServer) settings() map[string]string {
+	return map[string]string{
+		CONF_CC:            "Someone <someone@example.com>",
+		CONF_SMTP_SERVER:   s.Addr(),
+		CONF_SMTP_INSECURE: "true",
+	}
+}
+
+// Send the message, only the error is of interest.
+func trySend(message *Message) error {
+	r := newRunner(time.Now(), false, false)
+	defer r.close()
+
+	_, err := r.sendMessage(*message, nil)
+	return err
+}
+
+func TestTlsMode(t *testing.T) {
+	message := newTestMessage(nil)
+
+	mode, err := tlsMode(message)
+	assert.Nil(t, err)
+	assert.Equal(t, TLS_STARTTLS_OPTIONAL, mode)
+
+	message.Conf.Set(CONF_SMTP_TLS, "Implicit")
+	mode, err = tlsMode(message)
+	assert.Nil(t, err)
+	assert.Equal(t, TLS_IMPLICIT, mode)
+
+	message.Conf.Set(CONF_SMTP_TLS, "ssl")
+	_, err = tlsMode(message)
+	assert.NotNil(t, err)
+}
+
+func TestDeliverSMTP_Modes(t *testing.T) {
+	plain := newFakeSMTPServer(t, false, true)
+	defer plain.Close()
+
+	implicit := newFakeSMTPServer(t, true, false)
+	defer implicit.Close()
+
+	noStartTLS := newFakeSMTPServer(t, false, false)
+	defer noStartTLS.Close()
+
+	tests := []struct {
+		server  *fakeSMTPServer
+		mode    string
+		ok      bool
+		withTLS bool
+	}{
+		{plain, TLS_STARTTLS, true, true},
+		{plain, TLS_STARTTLS_OPTIONAL, true, true},
+		{plain, TLS_NONE, true, false},
+		{implicit, TLS_IMPLICIT, true, true},
+		{noStartTLS, TLS_STARTTLS_OPTIONAL, true, false},
+		{noStartTLS, TLS_STARTTLS, false, false},
+	}
+
+	for _, test := range tests {
+		message := newTestMessage(test.server.settings())
+		message.Conf.Set(CONF_SMTP_TLS, test.mode)
+
+		before := len(test.server.Mails())
+		err := trySend(message)
+
+		if !test.ok {
+			assert.NotNil(t, err, test.mode)
+			continue
+		}
+
+		require.Nil(t, err, test.mode)
+
+		mails := test.server.Mails()
+		require.Equal(t, before+1, len(mails), test.mode)
+
+		mail := mails[len(mails)-1]
+		assert.Equal(t, test.withTLS, mail.tls, test.mode)
+		assert.Equal(t, []string{"you@example.com", "someone@example.com"}, mail.to)
+	}
+}
+
+func TestSMTPTransport_Session(t *testing.T) {
+	server := newFakeSMTPServer(t, false, false)
+	server.reject = "nobody@example.com"
+	defer server.Close()
+
+	rejected := newTestMessage(server.settings())
+	rejected.Conf.Set(CONF_TO, "nobody@example.com")
+	rejected.Conf.Set(CONF_CC, "")
+
+	r := newRunner(time.Now(), false, false)
+
+	for _, message := range []*Message{newTestMessage(server.settings()), rejected, newTestMessage(server.settings())} {
+		_, err := r.sendMessage(*message, nil)
+		assert.Equal(t, message != rejected, err == nil)
+	}
+
+	r.close()
+
+	// All messages went over one connection, even after the rejection.
+	connections, resets, quits := server.Counts()
+	assert.Equal(t, 2, len(server.Mails()))
+	assert.Equal(t, 1, connections)
+	assert.Equal(t, 2, resets)
+	assert.Equal(t, 1, quits)
+}
+
+func TestSMTPTransport_Reconnect(t *testing.T) {
+	server := newFakeSMTPServer(t, false, false)
+	server.dropAfterMail = true
+	defer server.Close()
+
+	r := newRunner(time.Now(), false, false)
+	defer r.close()
+
+	for i := 0; i < 2; i++ {
+		_, err := r.sendMessage(*newTestMessage(server.settings()), nil)
+		require.Nil(t, err)
+	}
+
+	connections, _, _ := server.Counts()
+	assert.Equal(t, 2, len(server.Mails()))
+	assert.Equal(t, 2, connections)
+}
+
+func TestSMTPTransport_PartiallyRejected(t *testing.T) {
+	server := newFakeSMTPServer(t, false, false)
+	server.reject = "someone@example.com"
+	defer server.Close()
+
+	r := newRunner(time.Now(), false, false)
+	defer r.close()
+
+	delivery, err := r.sendMessage(*newTestMessage(server.settings()), nil)
+	require.Nil(t, err)
+
+	require.Equal(t, 2, len(delivery.Recipients))
+	assert.Equal(t, RecipientStatus{Address: "you@example.com"}, delivery.Recipients[0])
+	assert.Equal(t, "someone@example.com", delivery.Recipients[1].Address)
+	assert.True(t, strings.Contains(delivery.Recipients[1].Err.Error(), "No such user"))
+	assert.Equal(t, delivery.Recipients[1:], delivery.Rejected())
+
+	mails := server.Mails()
+	require.Equal(t, 1, len(mails))
+	assert.Equal(t, []string{"you@example.com"}, mails[0].to)
+
+	// Recipients that are done already are left out.
+	delivery, err = r.sendMessage(*newTestMessage(server.settings()), []string{"SOMEONE@example.com"})
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(delivery.Recipients))
+
+	// If nobody takes the message, a single temporary rejection is enough
+	// to try again later.
+	server.greylist = "you@example.com"
+
+	_, err = r.sendMessage(*newTestMessage(server.settings()), nil)
+	require.NotNil(t, err)
+	assert.True(t, isTemporary(err))
+	assert.Contains(t, err.Error(), "you@example.com: 450")
+	assert.Contains(t, err.Error(), "someone@example.com: 550")
+	assert.Equal(t, 2, len(server.Mails()))
+
+	// The session survives the temporary rejection.
+	server.greylist = ""
+
+	_, err = r.sendMessage(*newTestMessage(server.settings()), nil)
+	require.Nil(t, err)
+
+	connections, _, _ := server.Counts()
+	assert.Equal(t, 3, len(server.Mails()))
+	assert.Equal(t, 1, connections)
+}
+
+func TestSMTPServers(t *testing.T) {
+	message := newTestMessage(map[string]string{
+		CONF_SMTP_PORT:   "587",
+		CONF_SMTP_SERVER: "mail.example.com",
+	})
+
+	servers, err := smtpServers(message)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"mail.example.com:587"}, servers)
+
+	message.Conf.Set(CONF_SMTP_SERVER, "a.example.com, b.example.com:25, [::1]")
+	servers, err = smtpServers(message)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a.example.com:587", "b.example.com:25", "[::1]:587"}, servers)
+
+	message.Conf.Set(CONF_SMTP_SERVER, "20 backup.example.com, 10 a.example.com, 10 b.example.com")
+	servers, err = smtpServers(message)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a.example.com:587", "b.example.com:587", "backup.example.com:587"}, servers)
+
+	message.Conf.Set(CONF_SMTP_SERVER, "high a.example.com")
+	_, err = smtpServers(message)
+	assert.NotNil(t, err)
+}
+
+// The address of a port nobody listens on.
+func closedAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	addr := l.Addr().String()
+	l.Close()
+
+	return addr
+}
+
+func TestSMTPTransport_Failover(t *testing.T) {
+	busy := newFakeSMTPServer(t, false, false)
+	busy.tempfail = true
+	defer busy.Close()
+
+	good := newFakeSMTPServer(t, false, false)
+	defer good.Close()
+
+	message := newTestMessage(good.settings())
+	message.Conf.Set(CONF_SMTP_SERVER, closedAddr(t)+", "+busy.Addr()+", "+good.Addr())
+
+	r := newRunner(time.Now(), false, false)
+	defer r.close()
+
+	delivery, err := r.sendMessage(*message, nil)
+	require.Nil(t, err)
+	assert.Contains(t, delivery.Info, "Accepted by "+good.Addr()+".")
+	assert.Contains(t, delivery.Info, busy.Addr()+": 451")
+
+	// The next message goes straight to the server that worked.
+	delivery, err = r.sendMessage(*message, nil)
+	require.Nil(t, err)
+	assert.Equal(t, "Accepted by "+good.Addr()+".", delivery.Info)
+
+	busyConnections, _, _ := busy.Counts()
+	goodConnections, _, _ := good.Counts()
+	assert.Equal(t, 1, busyConnections)
+	assert.Equal(t, 1, goodConnections)
+	assert.Equal(t, 2, len(good.Mails()))
+}
+
+func TestSMTPTransport_FailoverGivesUp(t *testing.T) {
+	strict := newFakeSMTPServer(t, false, false)
+	strict.reject = "nobody@example.com"
+	defer strict.Close()
+
+	good := newFakeSMTPServer(t, false, false)
+	defer good.Close()
+
+	// A permanent failure is not worth trying elsewhere.
+	message := newTestMessage(good.settings())
+	message.Conf.Set(CONF_TO, "nobody@example.com")
+	message.Conf.Set(CONF_CC, "")
+	message.Conf.Set(CONF_SMTP_SERVER, strict.Addr()+", "+good.Addr())
+
+	err := trySend(message)
+	require.NotNil(t, err)
+	assert.False(t, isTemporary(err))
+	assert.Equal(t, 0, len(good.Mails()))
+
+	// If no server can be reached, it is worth trying again later.
+	message.Conf.Set(CONF_SMTP_SERVER, closedAddr(t)+", "+closedAddr(t))
+
+	err = trySend(message)
+	require.NotNil(t, err)
+	assert.True(t, isTemporary(err))
+	assert.Contains(t, err.Error(), "all servers failed")
+}
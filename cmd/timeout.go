@@ -0,0 +1,138 @@
+/* timeout.go: give up on servers that do not answer
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	. "github.com/githubert/lettersnail/common"
+	"net"
+	"time"
+)
+
+const (
+	DEFAULT_CONNECT_TIMEOUT = 30 * time.Second
+
+	// RFC 5321, section 4.5.3.2, asks clients to wait at least five minutes
+	// for most replies.
+	DEFAULT_COMMAND_TIMEOUT = 5 * time.Minute
+)
+
+// Return the duration set for `key`, or `fallback` if there is none. A value
+// of 0 means no timeout.
+func timeout(message *Message, key string, fallback time.Duration) (time.Duration, error) {
+	if message.Get(key) == "" {
+		return fallback, nil
+	}
+
+	d, err := message.Conf.GetDuration(key)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if d < 0 {
+		return 0, fmt.Errorf("'%s' must not be negative", key)
+	}
+
+	return d, nil
+}
+
+// Connect to `addr` through `d`, giving up after `timeout`, or when `ctx` is
+// done. A `timeout` of 0 means no timeout.
+func dialWithin(ctx context.Context, d dialer, network, addr string, timeout time.Duration) (net.Conn, error) {
+	dialCtx := ctx
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	conn, err := d.DialContext(dialCtx, network, addr)
+
+	if err != nil && dialCtx.Err() != nil && ctx.Err() == nil {
+		err = fmt.Errorf("no connection to %s within '%s' (%s): %w", addr, CONF_CONNECT_TIMEOUT, timeout, err)
+	}
+
+	return conn, err
+}
+
+// A connection that gives up on reads and writes that take longer than
+// `timeout`, or go beyond the deadline of `ctx`. The context is replaced for
+// every message sent through the connection.
+type deadlineConn struct {
+	net.Conn
+	ctx     context.Context
+	timeout time.Duration
+}
+
+// Set the deadline for the next read or write.
+func (c *deadlineConn) arm() error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+
+	var deadline time.Time
+
+	if c.timeout > 0 {
+		deadline = time.Now().Add(c.timeout)
+	}
+
+	if d, ok := c.ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+
+	return c.Conn.SetDeadline(deadline)
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if err := c.arm(); err != nil {
+		return 0, c.explain(err)
+	}
+
+	n, err := c.Conn.Read(b)
+
+	return n, c.explain(err)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	if err := c.arm(); err != nil {
+		return 0, c.explain(err)
+	}
+
+	n, err := c.Conn.Write(b)
+
+	return n, c.explain(err)
+}
+
+// Say which timeout it was, the bare "i/o timeout" does not tell much.
+func (c *deadlineConn) explain(err error) error {
+	var netErr net.Error
+
+	if err == nil || !errors.As(err, &netErr) || !netErr.Timeout() {
+		return err
+	}
+
+	if c.ctx.Err() != nil {
+		return fmt.Errorf("'%s' reached: %w", CONF_RUN_TIMEOUT, err)
+	}
+
+	return fmt.Errorf("no answer within '%s' (%s): %w", CONF_COMMAND_TIMEOUT, c.timeout, err)
+}
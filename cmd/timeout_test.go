@@ -0,0 +1,134 @@
+/* timeout_test.go: tests for the delivery timeouts
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"context"
+	. "github.com/githubert/lettersnail/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Return the address of a server that accepts connections, but never says a
+// word.
+func silentAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	var mu sync.Mutex
+	conns := []net.Conn{}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+
+			if err != nil {
+				return
+			}
+
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+
+	t.Cleanup(func() {
+		l.Close()
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+
+	return l.Addr().String()
+}
+
+func TestDeliverSMTP_Timeouts(t *testing.T) {
+	message := newTestMessage(map[string]string{
+		CONF_SMTP_SERVER:     silentAddr(t),
+		CONF_SMTP_TLS:        TLS_NONE,
+		CONF_COMMAND_TIMEOUT: "100ms",
+	})
+
+	start := time.Now()
+	err := trySend(message)
+
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "'command-timeout' (100ms)")
+	assert.True(t, isTemporary(err))
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	// A proxy that never answers keeps the connection from being
+	// established.
+	message.Conf.Set(CONF_PROXY, "socks5://"+silentAddr(t))
+	message.Conf.Set(CONF_CONNECT_TIMEOUT, "100ms")
+
+	err = trySend(message)
+
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "'connect-timeout' (100ms)")
+	assert.True(t, isTemporary(err))
+
+	message.Conf.Set(CONF_CONNECT_TIMEOUT, "soon")
+	assert.NotNil(t, trySend(message))
+}
+
+func TestProcessMessage_RunTimeout(t *testing.T) {
+	workdir := testWorkdir(t)
+
+	conf := testConfiguration(workdir, TRANSPORT_SMTP)
+	conf.Set(CONF_SMTP_SERVER, silentAddr(t))
+	conf.Set(CONF_SMTP_TLS, TLS_NONE)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	r := newRunner(time.Now(), false, false)
+	r.ctx = ctx
+	defer r.close()
+
+	// The server never answers, but the run ends before the command
+	// timeout. The message is tried again later.
+	first := todoMessage(t, workdir, "1.msg", conf)
+	require.Nil(t, r.processMessage(first))
+
+	state, err := loadRetryState(&first)
+	require.Nil(t, err)
+	assert.Equal(t, 1, state.Attempts)
+	assert.Contains(t, state.LastError, "'run-timeout' reached")
+
+	// Once the time is up, messages are not even tried.
+	second := todoMessage(t, workdir, "2.msg", conf)
+	require.Nil(t, r.processMessage(second))
+
+	assertExists(t, filepath.Join(workdir, DIR_TODO, "2.msg"))
+	state, err = loadRetryState(&second)
+	require.Nil(t, err)
+	assert.Equal(t, 0, state.Attempts)
+
+	assert.Equal(t, runStats{retrying: 1, notAttempted: 1}, r.stats)
+	assert.Equal(t, "0 sent, 0 failed, 1 to be retried, 0 held back, 1 not attempted and left in todo/.", r.stats.String())
+}
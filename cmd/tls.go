@@ -0,0 +1,180 @@
+/* tls.go: TLS configuration for outgoing connections
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	. "github.com/githubert/lettersnail/common"
+	"io/ioutil"
+	"strings"
+)
+
+// Build the TLS configuration for connecting to `host`. Use `insecure` to
+// work around things like self-signed certificates, though a private CA
+// (CONF_TLS_CA_FILE) or a pinned key (CONF_TLS_PIN_SHA256) should be
+// preferred.
+func tlsConfig(message *Message, host string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: insecure,
+	}
+
+	if name := message.Get(CONF_TLS_SERVER_NAME); name != "" {
+		config.ServerName = name
+	}
+
+	if file := message.Get(CONF_TLS_CA_FILE); file != "" {
+		pem, err := ioutil.ReadFile(file)
+
+		if err != nil {
+			return nil, fmt.Errorf("reading '%s': %s", CONF_TLS_CA_FILE, err.Error())
+		}
+
+		config.RootCAs = x509.NewCertPool()
+
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", file)
+		}
+	}
+
+	cert, key := message.Get(CONF_TLS_CLIENT_CERT), message.Get(CONF_TLS_CLIENT_KEY)
+
+	if cert != "" || key != "" {
+		if key == "" {
+			// Certificate and key may live in the same file.
+			key = cert
+		}
+
+		pair, err := tls.LoadX509KeyPair(cert, key)
+
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %s", err.Error())
+		}
+
+		config.Certificates = []tls.Certificate{pair}
+	}
+
+	// A pin is checked even if the certificate is not verified otherwise.
+	if pins := message.Get(CONF_TLS_PIN_SHA256); pins != "" {
+		accepted, err := parsePins(pins)
+
+		if err != nil {
+			return nil, err
+		}
+
+		roots := config.RootCAs
+
+		if insecure {
+			roots = nil
+		}
+
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = verifyPins(accepted, roots, config.ServerName)
+	}
+
+	return config, nil
+}
+
+// Calculate the pin of a certificate, which is the base64 encoded SHA-256
+// hash of its public key (as used by HPKP, see RFC 7469).
+func publicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Parse the comma-separated pins, which may be prefixed with "sha256/".
+func parsePins(pins string) (map[string]bool, error) {
+	accepted := map[string]bool{}
+
+	for _, pin := range strings.Split(pins, ",") {
+		pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+
+		if pin == "" {
+			continue
+		}
+
+		if raw, err := base64.StdEncoding.DecodeString(pin); err != nil || len(raw) != sha256.Size {
+			return nil, fmt.Errorf("'%s' is not a base64 encoded SHA-256 hash: %s", CONF_TLS_PIN_SHA256, pin)
+		}
+
+		accepted[pin] = true
+	}
+
+	return accepted, nil
+}
+
+// Build a function for tls.Config.VerifyPeerCertificate, which accepts the
+// connection if the certificate of the server matches one of the pins. The
+// handshake only proves that the server has the key of that certificate, the
+// others it presents may be anybody's. With `roots`, the chain is verified for
+// `name` first, and a pin may match any certificate of it, like the CA.
+func verifyPins(accepted map[string]bool, roots *x509.CertPool, name string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		certs := []*x509.Certificate{}
+
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+
+			if err != nil {
+				return err
+			}
+
+			certs = append(certs, cert)
+		}
+
+		if len(certs) == 0 {
+			return fmt.Errorf("no certificate presented by the server")
+		}
+
+		candidates := certs[:1]
+
+		if roots != nil {
+			opts := x509.VerifyOptions{
+				Roots:         roots,
+				DNSName:       name,
+				Intermediates: x509.NewCertPool(),
+			}
+
+			for _, cert := range certs[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+
+			chains, err := certs[0].Verify(opts)
+
+			if err != nil {
+				return err
+			}
+
+			for _, chain := range chains {
+				candidates = append(candidates, chain[1:]...)
+			}
+		}
+
+		for _, cert := range candidates {
+			if accepted[publicKeyPin(cert)] {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("the certificate of the server does not match '%s'", CONF_TLS_PIN_SHA256)
+	}
+}
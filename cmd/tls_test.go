@@ -0,0 +1,144 @@
+/* tls_test.go: unit tests for the TLS configuration
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"github.com/docopt/docopt.go"
+	. "github.com/githubert/lettersnail/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// Write the certificate as PEM file to `dir`, to be used as CA.
+func writeCA(t *testing.T, dir string, cert tls.Certificate) string {
+	file := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	require.Nil(t, ioutil.WriteFile(file, ca, 0600))
+
+	return file
+}
+
+func TestTlsConfig_CAFile(t *testing.T) {
+	server := newFakeSMTPServer(t, true, false)
+	defer server.Close()
+
+	dir := testWorkdir(t)
+
+	message := newTestMessage(server.settings())
+	message.Conf.Set(CONF_SMTP_TLS, TLS_IMPLICIT)
+	message.Conf.Set(CONF_SMTP_INSECURE, "false")
+
+	// The certificate is unknown...
+	assert.NotNil(t, trySend(message))
+
+	// ...unless our own CA is used.
+	message.Conf.Set(CONF_TLS_CA_FILE, writeCA(t, dir, server.certificate))
+	assert.Nil(t, trySend(message))
+
+	// The name has to match, though.
+	message.Conf.Set(CONF_TLS_SERVER_NAME, "mail.example.com")
+	assert.NotNil(t, trySend(message))
+
+	message.Conf.Set(CONF_TLS_CA_FILE, filepath.Join(dir, "missing.pem"))
+	assert.NotNil(t, trySend(message))
+}
+
+func TestTlsConfig_InsecureFromIni(t *testing.T) {
+	iniFile := filepath.Join(testWorkdir(t), "lettersnail.ini")
+	require.Nil(t, ioutil.WriteFile(iniFile, []byte("[run]\ninsecure = true\n"), 0600))
+
+	// As in main() and Run(): the INI first, then the command line, which
+	// does not have --insecure.
+	conf := NewConfiguration()
+	conf.Set(CONF_CONFIG_FILENAME, iniFile)
+	conf.MergeWithIni(CMD_RUN)
+
+	args, err := docopt.Parse(usageRun, []string{CMD_RUN}, true, "", false)
+	require.Nil(t, err)
+	conf.MergeWithDocOptArgs(CMD_RUN, &args)
+
+	message := newTestMessage(map[string]string{CONF_SMTP_SERVER: "mail.example.com"})
+	message.MergeWith(conf)
+
+	transport, err := newSMTPTransport(message)
+	require.Nil(t, err)
+	assert.True(t, transport.(*smtpTransport).servers[0].config.InsecureSkipVerify)
+}
+
+func TestTlsConfig_Pin(t *testing.T) {
+	server := newFakeSMTPServer(t, false, true)
+	defer server.Close()
+
+	message := newTestMessage(server.settings())
+	message.Conf.Set(CONF_SMTP_TLS, TLS_STARTTLS)
+	message.Conf.Set(CONF_SMTP_INSECURE, "false")
+
+	message.Conf.Set(CONF_TLS_PIN_SHA256, "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=")
+	assert.NotNil(t, trySend(message))
+
+	message.Conf.Set(CONF_TLS_PIN_SHA256, "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=, sha256/"+publicKeyPin(server.certificate.Leaf))
+	assert.Nil(t, trySend(message))
+
+	// The pin is not ignored if the certificate is not verified otherwise.
+	message.Conf.Set(CONF_SMTP_INSECURE, "true")
+	message.Conf.Set(CONF_TLS_PIN_SHA256, "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=")
+	assert.NotNil(t, trySend(message))
+
+	message.Conf.Set(CONF_TLS_PIN_SHA256, "not a pin")
+	assert.NotNil(t, trySend(message))
+
+	// Someone else presenting the pinned certificate along with their own.
+	message.Conf.Set(CONF_TLS_PIN_SHA256, publicKeyPin(server.certificate.Leaf))
+
+	config, err := tlsConfig(message, "127.0.0.1", true)
+	require.Nil(t, err)
+
+	other := testCertificate(t).Certificate[0]
+	assert.NotNil(t, config.VerifyPeerCertificate([][]byte{other, server.certificate.Certificate[0]}, nil))
+	assert.Nil(t, config.VerifyPeerCertificate([][]byte{server.certificate.Certificate[0], other}, nil))
+}
+
+func TestTlsConfig_PinAndCAFile(t *testing.T) {
+	server := newFakeSMTPServer(t, false, true)
+	defer server.Close()
+
+	dir := testWorkdir(t)
+
+	message := newTestMessage(server.settings())
+	message.Conf.Set(CONF_SMTP_TLS, TLS_STARTTLS)
+	message.Conf.Set(CONF_SMTP_INSECURE, "false")
+	message.Conf.Set(CONF_TLS_PIN_SHA256, publicKeyPin(server.certificate.Leaf))
+	message.Conf.Set(CONF_TLS_CA_FILE, writeCA(t, dir, server.certificate))
+
+	assert.Nil(t, trySend(message))
+
+	// With a CA, the name is still checked...
+	message.Conf.Set(CONF_TLS_SERVER_NAME, "mail.example.com")
+	assert.NotNil(t, trySend(message))
+
+	message.Conf.Set(CONF_TLS_SERVER_NAME, "")
+
+	// ...and so is the issuer.
+	message.Conf.Set(CONF_TLS_CA_FILE, writeCA(t, dir, testCertificate(t)))
+	assert.NotNil(t, trySend(message))
+}
@@ -0,0 +1,233 @@
+/* transport.go: pluggable delivery of messages
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	. "github.com/githubert/lettersnail/common"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Supported values for CONF_TRANSPORT.
+const (
+	TRANSPORT_SMTP     = "smtp"
+	TRANSPORT_SENDMAIL = "sendmail"
+	TRANSPORT_MAILDIR  = "maildir"
+	TRANSPORT_MBOX     = "mbox"
+	TRANSPORT_LMTP     = "lmtp"
+	TRANSPORT_WEBHOOK  = "webhook"
+)
+
+// A message prepared for delivery.
+type Envelope struct {
+	// The message this envelope was prepared from.
+	Message *Message
+
+	// Envelope sender and recipients (To, Cc and Bcc), as plain addresses.
+	From       string
+	Recipients []string
+
+	// The rendered message, as produced by prepareEmail().
+	Data []byte
+}
+
+// The outcome of a successful delivery.
+type Delivery struct {
+	// A short summary for the log, like which server accepted the message.
+	Info string
+
+	// What became of each recipient. Transports that cannot tell leave
+	// this empty, then all recipients count as accepted.
+	Recipients []RecipientStatus
+}
+
+// Whether a recipient was accepted, and if not, why.
+type RecipientStatus struct {
+	Address string
+
+	// The reply of the server if the recipient was rejected.
+	Err error
+}
+
+// Return the recipients that were rejected.
+func (d *Delivery) Rejected() []RecipientStatus {
+	rejected := []RecipientStatus{}
+
+	for _, status := range d.Recipients {
+		if status.Err != nil {
+			rejected = append(rejected, status)
+		}
+	}
+
+	return rejected
+}
+
+// Leave out the given recipients, for example those that got the message in
+// an earlier attempt already.
+func (e *Envelope) without(addresses []string) *Envelope {
+	rest := *e
+	rest.Recipients = []string{}
+
+	for _, recipient := range e.Recipients {
+		if !containsFold(addresses, recipient) {
+			rest.Recipients = append(rest.Recipients, recipient)
+		}
+	}
+
+	return &rest
+}
+
+// A Transport delivers an Envelope to its destination. A transport may be
+// used for several messages, and may keep connections open until Close() is
+// called. Deliver gives up when the context is done.
+type Transport interface {
+	Deliver(ctx context.Context, envelope *Envelope) (*Delivery, error)
+
+	Close() error
+
+	// Describe where messages are delivered to.
+	String() string
+}
+
+// Parameters describing the message itself, but not how it is delivered.
+var contentKeys = map[string]bool{
+	CONF_DATE:     true,
+	CONF_SUBJECT:  true,
+	CONF_TO:       true,
+	CONF_FROM:     true,
+	CONF_REPLY_TO: true,
+	CONF_CC:       true,
+	CONF_BCC:      true,
+	CONF_ENCRYPT:  true,
+	CONF_SIGN:     true,
+
+	CONF_SMIME_SIGN:    true,
+	CONF_SMIME_ENCRYPT: true,
+	CONF_TRACE_HEADERS: true,
+
+	CONF_PARTIAL_FAILURE: true,
+	CONF_ATTACH:          true,
+	CONF_FORMAT:          true,
+}
+
+// Messages with the same key may share a transport. This is the case if
+// their configurations only differ in their content.
+func transportKey(message *Message) string {
+	var key bytes.Buffer
+
+	for _, k := range message.Conf.Keys() {
+		if !contentKeys[k] {
+			fmt.Fprintf(&key, "%q=%q\n", k, message.Get(k))
+		}
+	}
+
+	return key.String()
+}
+
+// Constructors for the known transports.
+var transports = map[string]func(message *Message) (Transport, error){
+	TRANSPORT_SMTP:     newSMTPTransport,
+	TRANSPORT_SENDMAIL: newSendmailTransport,
+	TRANSPORT_MAILDIR:  newMaildirTransport,
+	TRANSPORT_MBOX:     newMboxTransport,
+	TRANSPORT_LMTP:     newLMTPTransport,
+	TRANSPORT_WEBHOOK:  newWebhookTransport,
+}
+
+// Create the transport configured for the given message.
+func newTransport(message *Message) (Transport, error) {
+	name := strings.ToLower(message.Get(CONF_TRANSPORT))
+
+	if name == "" {
+		name = TRANSPORT_SMTP
+	}
+
+	constructor, ok := transports[name]
+
+	if !ok {
+		known := []string{}
+
+		for k := range transports {
+			known = append(known, k)
+		}
+
+		sort.Strings(known)
+
+		return nil, fmt.Errorf("unknown transport '%s' (known: %s)", name, strings.Join(known, ", "))
+	}
+
+	return constructor(message)
+}
+
+// Prepare the given message for delivery.
+func prepareEnvelope(message *Message) (*Envelope, error) {
+	e, err := prepareEmail(message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	from, recipients, err := envelopeAddresses(e)
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := e.Bytes()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if data, err = pgpProtect(message, data, recipients); err != nil {
+		return nil, err
+	}
+
+	if data, err = smimeProtect(message, data, recipients); err != nil {
+		return nil, err
+	}
+
+	signer, err := newDKIMSigner(message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if signer != nil {
+		if data, err = signer.Sign(data, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Envelope{
+		Message:    message,
+		From:       from,
+		Recipients: recipients,
+		Data:       data,
+	}, nil
+}
+
+// Local mail handling usually expects plain newlines instead of the CRLF line
+// endings used on the wire.
+func unixLineEndings(data []byte) []byte {
+	return bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+}
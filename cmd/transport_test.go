@@ -0,0 +1,234 @@
+/* transport_test.go: unit tests for the transport handling
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"context"
+	"fmt"
+	. "github.com/githubert/lettersnail/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A transport that keeps all messages in memory.
+type memoryTransport struct {
+	envelopes []*Envelope
+
+	// If set, every delivery fails with this error.
+	err error
+
+	closed bool
+}
+
+func (t *memoryTransport) Deliver(ctx context.Context, envelope *Envelope) (*Delivery, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+
+	t.envelopes = append(t.envelopes, envelope)
+
+	return &Delivery{Info: "Kept in memory."}, nil
+}
+
+func (t *memoryTransport) Close() error {
+	t.closed = true
+	return nil
+}
+
+func (t *memoryTransport) String() string {
+	return "memory"
+}
+
+// Register a memoryTransport as "memory" for the duration of a test.
+func useMemoryTransport(t *testing.T) *memoryTransport {
+	transport := &memoryTransport{}
+
+	transports["memory"] = func(*Message) (Transport, error) { return transport, nil }
+	t.Cleanup(func() { delete(transports, "memory") })
+
+	return transport
+}
+
+// Create a temporary working directory with all necessary folders.
+func testWorkdir(t *testing.T) string {
+	workdir, err := ioutil.TempDir("", "lettersnail")
+	require.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(workdir) })
+
+	for _, dir := range []string{DIR_TODO, DIR_DONE, DIR_ERRORS, DIR_DRAFTS} {
+		require.Nil(t, os.Mkdir(filepath.Join(workdir, dir), 0777))
+	}
+
+	return workdir
+}
+
+// A run in `workdir`, delivering through `transport`.
+func testConfiguration(workdir string, transport string) *Configuration {
+	conf := NewConfiguration()
+	conf.Set(CONF_WORKDIR, workdir)
+	conf.Set(CONF_TRANSPORT, transport)
+
+	return conf
+}
+
+// A message from me@example.com to you@example.com, which is due already.
+// The given settings are added, or replace the defaults.
+func newTestMessage(settings map[string]string) *Message {
+	message := NewMessage()
+	message.Name = "test.msg"
+	message.Conf.Set(CONF_FROM, "me@example.com")
+	message.Conf.Set(CONF_TO, "you@example.com")
+	message.Conf.Set(CONF_SUBJECT, "Test")
+	message.Conf.Set(CONF_DATE, "2000-01-01")
+	message.Body = []string{"Hello."}
+
+	for k, v := range settings {
+		message.Conf.Set(k, v)
+	}
+
+	return message
+}
+
+// Write a message to the todo/ folder and load it again, merged with `conf`.
+// Without `lines`, it is the message of newTestMessage.
+func todoMessage(t *testing.T, workdir string, name string, conf *Configuration, lines ...string) Message {
+	path := filepath.Join(workdir, DIR_TODO, name)
+
+	if len(lines) == 0 {
+		lines = []string{
+			"from: me@example.com",
+			"to: you@example.com",
+			"subject: Test",
+			"date: 2000-01-01",
+			"",
+			"Hello.",
+		}
+	}
+
+	content := ""
+
+	for _, line := range lines {
+		content += line + "\n"
+	}
+
+	require.Nil(t, ioutil.WriteFile(path, []byte(content), 0666))
+
+	message, err := NewMessageFromFile(path)
+	require.Nil(t, err)
+
+	message.MergeWith(conf)
+
+	return message
+}
+
+func assertExists(t *testing.T, path string) {
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected %s to exist: %s", path, err)
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	message := NewMessage()
+
+	transport, err := newTransport(message)
+	assert.Nil(t, err)
+	assert.IsType(t, &smtpTransport{}, transport)
+
+	message.Conf.Set(CONF_TRANSPORT, "carrier-pigeon")
+	_, err = newTransport(message)
+	assert.NotNil(t, err)
+}
+
+func TestProcessMessage(t *testing.T) {
+	transport := useMemoryTransport(t)
+	workdir := testWorkdir(t)
+
+	conf := testConfiguration(workdir, "memory")
+	conf.Set(CONF_FROM, "me@example.com")
+	conf.Set(CONF_SMTP_PASSWORD, "hunter2")
+
+	message := todoMessage(t, workdir, "1.msg", conf,
+		"to: you@example.com",
+		"bcc: hidden@example.com",
+		"subject: Test",
+		"date: 2000-01-01",
+		"",
+		"Hello.")
+
+	require.Nil(t, newRunner(time.Now(), false, false).processMessage(message))
+
+	require.Equal(t, 1, len(transport.envelopes))
+	assert.Equal(t, "me@example.com", transport.envelopes[0].From)
+	assert.Equal(t, []string{"you@example.com", "hidden@example.com"}, transport.envelopes[0].Recipients)
+	assert.NotContains(t, string(transport.envelopes[0].Data), "hidden@example.com")
+
+	assertExists(t, filepath.Join(workdir, DIR_DONE, "1.msg"))
+
+	log, err := ioutil.ReadFile(filepath.Join(workdir, DIR_DONE, "1.log"))
+	require.Nil(t, err)
+	assert.Contains(t, string(log), "Kept in memory.")
+	assert.NotContains(t, string(log), "hunter2")
+
+	_, id := messageID(&message)
+	assert.Contains(t, string(log), "Successfully delivered as "+id)
+	assert.Contains(t, string(transport.envelopes[0].Data), "Message-Id: "+id)
+
+	// Failed deliveries end up in errors/.
+	transport.err = fmt.Errorf("no pigeons left")
+
+	message = todoMessage(t, workdir, "2.msg", conf)
+
+	require.Nil(t, newRunner(time.Now(), false, false).processMessage(message))
+
+	assertExists(t, filepath.Join(workdir, DIR_ERRORS, "2.msg"))
+
+	log, err = ioutil.ReadFile(filepath.Join(workdir, DIR_ERRORS, "2.log"))
+	require.Nil(t, err)
+	assert.Contains(t, string(log), "no pigeons left")
+}
+
+func TestRunner_Transport(t *testing.T) {
+	transport := useMemoryTransport(t)
+
+	message := newTestMessage(map[string]string{CONF_TRANSPORT: "memory"})
+	other := newTestMessage(map[string]string{CONF_TRANSPORT: "memory", CONF_SUBJECT: "Other"})
+
+	assert.Equal(t, transportKey(message), transportKey(other))
+
+	other.Conf.Set(CONF_SMTP_USER, "me")
+	assert.NotEqual(t, transportKey(message), transportKey(other))
+
+	r := newRunner(time.Now(), false, false)
+
+	first, err := r.transport(message)
+	require.Nil(t, err)
+
+	second, err := r.transport(message)
+	require.Nil(t, err)
+
+	assert.True(t, first == second)
+	assert.False(t, transport.closed)
+
+	r.close()
+	assert.True(t, transport.closed)
+}
@@ -0,0 +1,262 @@
+/* webhook.go: deliver messages to an HTTP endpoint
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/githubert/lettersnail/common"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const WEBHOOK_TIMEOUT = 30 * time.Second
+
+// The payload sent, unless CONF_WEBHOOK_TEMPLATE says otherwise.
+const DEFAULT_WEBHOOK_TEMPLATE = `{
+  "name": {{json .Name}},
+  "date": {{json .Date}},
+  "from": {{json .From}},
+  "recipients": {{json .Recipients}},
+  "subject": {{json .Subject}},
+  "body": {{json .Body}}
+}
+`
+
+// The values available in a webhook template.
+type webhookData struct {
+	Name       string
+	Date       string
+	From       string
+	To         []string
+	Cc         []string
+	Recipients []string
+	Subject    string
+	Body       string
+}
+
+// POSTs messages to a URL, for chat systems or push notification services.
+type webhookTransport struct {
+	url      string
+	template *template.Template
+	headers  http.Header
+	client   *http.Client
+}
+
+func newWebhookTransport(message *Message) (Transport, error) {
+	url := message.Get(CONF_WEBHOOK_URL)
+
+	if url == "" {
+		return nil, fmt.Errorf("'%s' parameter is missing", CONF_WEBHOOK_URL)
+	}
+
+	text := DEFAULT_WEBHOOK_TEMPLATE
+
+	if file := message.Get(CONF_WEBHOOK_TEMPLATE); file != "" {
+		content, err := ioutil.ReadFile(file)
+
+		if err != nil {
+			return nil, fmt.Errorf("reading '%s': %s", CONF_WEBHOOK_TEMPLATE, err.Error())
+		}
+
+		text = string(content)
+	}
+
+	tmpl, err := template.New("webhook").Funcs(template.FuncMap{"json": toJSON}).Parse(text)
+
+	if err != nil {
+		return nil, err
+	}
+
+	headers := http.Header{}
+	headers.Set("Content-Type", "application/json")
+	headers.Set("User-Agent", "lettersnail")
+
+	for k, v := range message.Conf.Data {
+		if strings.HasPrefix(k, CONF_WEBHOOK_HEADER_PREFIX) {
+			headers.Set(k[len(CONF_WEBHOOK_HEADER_PREFIX):], v)
+		}
+	}
+
+	if token := message.Get(CONF_WEBHOOK_TOKEN); token != "" {
+		headers.Set("Authorization", "Bearer "+token)
+	}
+
+	return &webhookTransport{
+		url:      url,
+		template: tmpl,
+		headers:  headers,
+		client:   &http.Client{Timeout: WEBHOOK_TIMEOUT},
+	}, nil
+}
+
+// Encode a value for use in a JSON template. Unlike json.Marshal, '<', '>' and
+// '&' are kept as they are.
+func toJSON(v interface{}) (string, error) {
+	var buf bytes.Buffer
+
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(v); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+func (t *webhookTransport) Close() error {
+	return nil
+}
+
+func (t *webhookTransport) String() string {
+	names := []string{}
+
+	for k := range t.headers {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+
+	return fmt.Sprintf("webhook: POST %s (headers: %s)", RedactedURL(t.url), strings.Join(names, ", "))
+}
+
+// Render the payload for the given envelope.
+func (t *webhookTransport) payload(envelope *Envelope) ([]byte, error) {
+	message := envelope.Message
+
+	data := webhookData{
+		Name:       message.Name,
+		Date:       message.Get(CONF_DATE),
+		From:       envelope.From,
+		Recipients: envelope.Recipients,
+		Subject:    message.Get(CONF_SUBJECT),
+		Body:       strings.Join(message.Body, "\n"),
+	}
+
+	var err error
+
+	if data.To, err = getAddresses(message.Get(CONF_TO)); err != nil {
+		return nil, err
+	}
+
+	if cc := message.Get(CONF_CC); cc != "" {
+		if data.Cc, err = getAddresses(cc); err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+
+	if err := t.template.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (t *webhookTransport) Deliver(ctx context.Context, envelope *Envelope) (*Delivery, error) {
+	if err := verifyWebhook(envelope.Message); err != nil {
+		return nil, err
+	}
+
+	body, err := t.payload(envelope)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", t.url, bytes.NewReader(body))
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid '%s'", CONF_WEBHOOK_URL)
+	}
+
+	for k, v := range t.headers {
+		req.Header[k] = v
+	}
+
+	resp, err := t.client.Do(req)
+
+	if err != nil {
+		var urlErr *url.Error
+
+		// It would end up in the log with the whole URL.
+		if errors.As(err, &urlErr) {
+			urlErr.URL = RedactedURL(t.url)
+		}
+
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	// The response is only of interest for the log, a short excerpt will do.
+	excerpt, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("%s responded with %s: %s", RedactedURL(t.url), resp.Status, strings.TrimSpace(string(excerpt)))
+
+		// Server errors and rate limiting will hopefully pass.
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			err = temporary(err)
+		}
+
+		return nil, err
+	}
+
+	return &Delivery{Info: fmt.Sprintf("%s responded with %s.", RedactedURL(t.url), resp.Status)}, nil
+}
+
+// The webhook sends the body as it is, it can neither sign nor encrypt it.
+// Rather than sending the message unprotected, it is refused.
+func verifyWebhook(message *Message) error {
+	if strings.ToLower(message.Get(CONF_TRANSPORT)) != TRANSPORT_WEBHOOK {
+		return nil
+	}
+
+	keys := []string{}
+
+	for _, key := range []string{CONF_ENCRYPT, CONF_SIGN} {
+		if p, err := protection(message, key); err == nil && p != PROTECT_NONE {
+			keys = append(keys, key)
+		}
+	}
+
+	for _, key := range []string{CONF_SMIME_ENCRYPT, CONF_SMIME_SIGN} {
+		if b, err := message.Conf.GetBool(key); err == nil && b {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) > 0 {
+		return fmt.Errorf("the webhook transport cannot sign or encrypt, remove '%s'", strings.Join(keys, "', '"))
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+/* webhook_test.go: unit tests for the webhook transport
+ *
+ * Copyright (C) 2016-2018 Clemens Fries <github-lettersnail@xenoworld.de>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"encoding/json"
+	. "github.com/githubert/lettersnail/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestWebhookTransport(t *testing.T) {
+	var request *http.Request
+	var body []byte
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	message := newTestMessage(map[string]string{
+		CONF_TRANSPORT:                          TRANSPORT_WEBHOOK,
+		CONF_WEBHOOK_URL:                        server.URL + "/notify",
+		CONF_WEBHOOK_TOKEN:                      "s3cr3t",
+		CONF_WEBHOOK_HEADER_PREFIX + "Priority": "high",
+		CONF_CC:                                 "Someone <someone@example.com>",
+	})
+	message.Body = []string{"Hello,", "world."}
+
+	require.Nil(t, trySend(message))
+
+	require.NotNil(t, request)
+	assert.Equal(t, "POST", request.Method)
+	assert.Equal(t, "/notify", request.URL.Path)
+	assert.Equal(t, "Bearer s3cr3t", request.Header.Get("Authorization"))
+	assert.Equal(t, "high", request.Header.Get("Priority"))
+	assert.Equal(t, "application/json", request.Header.Get("Content-Type"))
+
+	payload := map[string]interface{}{}
+	require.Nil(t, json.Unmarshal(body, &payload))
+
+	assert.Equal(t, "test.msg", payload["name"])
+	assert.Equal(t, "2000-01-01", payload["date"])
+	assert.Equal(t, "Test", payload["subject"])
+	assert.Equal(t, "Hello,\nworld.", payload["body"])
+	assert.Equal(t, []interface{}{"you@example.com", "someone@example.com"}, payload["recipients"])
+}
+
+func TestWebhookTransport_Template(t *testing.T) {
+	var body []byte
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	template := filepath.Join(testWorkdir(t), "template.json")
+	require.Nil(t, ioutil.WriteFile(template, []byte(`{"title": {{json .Subject}}, "to": {{json (index .To 0)}}}`), 0600))
+
+	require.Nil(t, trySend(newTestMessage(map[string]string{
+		CONF_TRANSPORT:        TRANSPORT_WEBHOOK,
+		CONF_WEBHOOK_URL:      server.URL,
+		CONF_WEBHOOK_TEMPLATE: template,
+		CONF_SUBJECT:          "\"Quoted\" subject",
+		CONF_TO:               "Me <me@example.com>",
+	})))
+
+	assert.Equal(t, `{"title": "\"Quoted\" subject", "to": "\"Me\" <me@example.com>"}`, string(body))
+}
+
+func TestWebhookTransport_Failure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid topic", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	message := newTestMessage(map[string]string{
+		CONF_TRANSPORT:   TRANSPORT_WEBHOOK,
+		CONF_WEBHOOK_URL: server.URL + "/hooks/s3cr3t",
+	})
+
+	err := trySend(message)
+
+	require.NotNil(t, err)
+	assert.False(t, isTemporary(err))
+	assert.Contains(t, err.Error(), "400 Bad Request: invalid topic")
+
+	// The path of the URL is often a secret, it stays out of the log.
+	assert.Contains(t, err.Error(), server.URL+"/"+REDACTED)
+	assert.NotContains(t, err.Error(), "s3cr3t")
+
+	message.Conf.Set(CONF_WEBHOOK_URL, "http://"+closedAddr(t)+"/hooks/s3cr3t")
+
+	err = trySend(message)
+	require.NotNil(t, err)
+	assert.NotContains(t, err.Error(), "s3cr3t")
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	message := newTestMessage(map[string]string{CONF_TRANSPORT: TRANSPORT_WEBHOOK})
+	assert.Nil(t, verifyWebhook(message))
+
+	// The body would go out unprotected.
+	message.Conf.Set(CONF_ENCRYPT, "pgp")
+	message.Conf.Set(CONF_SMIME_SIGN, "true")
+
+	err := verifyWebhook(message)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "'encrypt', 'smime-sign'")
+
+	message.Conf.Set(CONF_TRANSPORT, TRANSPORT_SMTP)
+	assert.Nil(t, verifyWebhook(message))
+}
+
+func TestWebhookTransport_TemporaryFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	err := trySend(newTestMessage(map[string]string{
+		CONF_TRANSPORT:   TRANSPORT_WEBHOOK,
+		CONF_WEBHOOK_URL: server.URL,
+	}))
+
+	require.NotNil(t, err)
+	assert.True(t, isTemporary(err))
+}
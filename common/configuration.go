@@ -20,18 +20,26 @@ package common
 import (
 	"fmt"
 	"github.com/go-ini/ini"
+	"net/url"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Configuration struct {
 	Data map[string]string
+
+	// Where a value came from, like "[default]" or "command line". Values
+	// without a source were set by the program itself.
+	Sources map[string]string
 }
 
 func NewConfiguration() *Configuration {
 	return &Configuration{
-		Data: map[string]string{},
+		Data:    map[string]string{},
+		Sources: map[string]string{},
 	}
 }
 
@@ -41,11 +49,111 @@ func (c *Configuration) Get(key string) string {
 
 func (c *Configuration) Set(key string, value string) {
 	c.Data[key] = value
+	delete(c.Sources, key)
+}
+
+// Set a value and remember where it came from.
+func (c *Configuration) SetFrom(key string, value string, source string) {
+	if c.Sources == nil {
+		c.Sources = map[string]string{}
+	}
+
+	c.Data[key] = value
+	c.Sources[key] = source
+}
+
+// Return where the value of `key` came from.
+func (c *Configuration) Source(key string) string {
+	return c.Sources[key]
+}
+
+// Return all keys in sorted order.
+func (c *Configuration) Keys() []string {
+	keys := make([]string, 0, len(c.Data))
+
+	for k := range c.Data {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Keys that may be given more than once. Their values are kept one per line.
+var listKeys = map[string]bool{
+	CONF_ATTACH: true,
+}
+
+// Return all values of `key`, for keys that may be given more than once.
+func (c *Configuration) GetList(key string) []string {
+	values := []string{}
+
+	for _, v := range strings.Split(c.Get(key), "\n") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
+
+// Return the value of `key` as boolean. An empty value is false.
+func (c *Configuration) GetBool(key string) (bool, error) {
+	v := c.Get(key)
+
+	if v == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(v)
+
+	if err != nil {
+		return false, fmt.Errorf("'%s' is not a boolean: %s", key, v)
+	}
+
+	return b, nil
+}
+
+// Return the value of `key` as an integer. An empty value is reported as 0.
+func (c *Configuration) GetInt(key string) (int, error) {
+	v := c.Get(key)
+
+	if v == "" {
+		return 0, nil
+	}
+
+	i, err := strconv.Atoi(v)
+
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is not a number: %s", key, v)
+	}
+
+	return i, nil
+}
+
+// Return the value of `key` as a duration like "90s" or "1h30m". An empty
+// value is reported as 0.
+func (c *Configuration) GetDuration(key string) (time.Duration, error) {
+	v := c.Get(key)
+
+	if v == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(v)
+
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is not a duration: %s", key, v)
+	}
+
+	return d, nil
 }
 
 // Load configuration from an array of strings in the form `key: value`.
 func (c *Configuration) Load(text []string) {
 	c.Data = map[string]string{}
+	c.Sources = map[string]string{}
 
 	for _, line := range text {
 		r := strings.SplitN(line, ":", 2)
@@ -53,7 +161,13 @@ func (c *Configuration) Load(text []string) {
 		key := strings.TrimSpace(r[0])
 
 		if len(r) == 2 {
-			c.Data[key] = strings.TrimSpace(r[1])
+			value := strings.TrimSpace(r[1])
+
+			if previous, ok := c.Data[key]; ok && listKeys[key] {
+				value = previous + "\n" + value
+			}
+
+			c.Data[key] = value
 		} else {
 			if key != "" {
 				c.Data[key] = ""
@@ -65,14 +179,18 @@ func (c *Configuration) Load(text []string) {
 // Merge the `src` configuration into this configuration.
 func (c *Configuration) MergeWith(src *Configuration) {
 	for k, v := range (*src).Data {
-		(*c).Data[k] = v
+		if source := src.Source(k); source != "" {
+			c.SetFrom(k, v, source)
+		} else {
+			c.Set(k, v)
+		}
 	}
 }
 
-// Merge arguments from a INI section into the given map.
-func mergeIniSection(section *ini.Section, dst *map[string]string) {
+// Merge an INI section, and remember the section as source of the values.
+func (c *Configuration) mergeWithSection(section *ini.Section) {
 	for _, k := range section.KeyStrings() {
-		(*dst)[k] = section.Key(k).String()
+		c.SetFrom(k, section.Key(k).String(), "["+section.Name()+"]")
 	}
 }
 
@@ -84,20 +202,50 @@ func (c *Configuration) MergeWithIni(cmd string) {
 		section, err := cfg.GetSection("default")
 
 		if err == nil {
-			mergeIniSection(section, &c.Data)
+			c.mergeWithSection(section)
 		}
 
 		section, err = cfg.GetSection(cmd)
 
 		if err == nil {
-			mergeIniSection(section, &c.Data)
+			c.mergeWithSection(section)
+		}
+	}
+}
+
+// Merges the "account `name`" section from CONF_CONFIG_FILENAME. The account's
+// settings take precedence over the other sections of the INI, but not over
+// the command line or the message itself.
+func (c *Configuration) MergeWithAccount(name string) error {
+	cfg, err := ini.Load(c.Get(CONF_CONFIG_FILENAME))
+
+	if err != nil {
+		return fmt.Errorf("account '%s': %s", name, err.Error())
+	}
+
+	section, err := cfg.GetSection(ACCOUNT_SECTION_PREFIX + name)
+
+	if err != nil {
+		return fmt.Errorf("account '%s' not found in %s", name, c.Get(CONF_CONFIG_FILENAME))
+	}
+
+	for _, k := range section.KeyStrings() {
+		switch c.Source(k) {
+		case SOURCE_COMMAND_LINE, SOURCE_MESSAGE:
+			continue
 		}
+
+		c.SetFrom(k, section.Key(k).String(), "["+section.Name()+"]")
 	}
+
+	return nil
 }
 
 // Merge arguments from the DocOpt parser into a configuration map. All
 // arguments that are not `nil` and start with "--" will be merged.
-// Booleans will be converted to strings.
+// Booleans will be converted to strings. DocOpt sets all flags, so those not
+// given on the command line are left out, and the INI or an account may
+// still set them.
 func (c *Configuration) MergeWithDocOptArgs(cmd string, args *map[string]interface{}) {
 	for k, v := range *args {
 
@@ -111,31 +259,91 @@ func (c *Configuration) MergeWithDocOptArgs(cmd string, args *map[string]interfa
 		if v != nil && (len(k) > 2 && k[0:2] == "--") {
 			switch v.(type) {
 			case string:
-				c.Data[k[2:]] = v.(string)
+				c.SetFrom(k[2:], v.(string), SOURCE_COMMAND_LINE)
 			case bool:
-				c.Data[k[2:]] = strconv.FormatBool(v.(bool))
+				if v.(bool) {
+					c.SetFrom(k[2:], strconv.FormatBool(v.(bool)), SOURCE_COMMAND_LINE)
+				}
 			}
 
 		}
 	}
 }
 
-// Dump the configuration as strings in the form `key: value`.
-func (c *Configuration) DumpConfig() []string {
-	keys := make([]string, len(c.Data))
+// Shown instead of the value of a secret setting.
+const REDACTED = "(redacted)"
+
+// Settings whose values must not end up in logs or on the screen.
+var secretKeys = map[string]bool{
+	CONF_SMTP_PASSWORD:  true,
+	CONF_PGP_PASSPHRASE: true,
+	CONF_WEBHOOK_TOKEN:  true,
+}
+
+// Headers of webhooks that carry credentials, by a part of their name.
+var secretHeaders = regexp.MustCompile(`(?i)auth|token|key|secret|password|cookie`)
 
-	i := 0
-	for k, _ := range c.Data {
-		keys[i] = k
-		i++
+// Whether the value of the given key is a secret.
+func isSecret(key string) bool {
+	if secretKeys[key] {
+		return true
 	}
 
-	sort.Strings(keys)
+	return strings.HasPrefix(key, CONF_WEBHOOK_HEADER_PREFIX) &&
+		secretHeaders.MatchString(key[len(CONF_WEBHOOK_HEADER_PREFIX):])
+}
+
+// Return the value of the given key for display. Secrets are replaced by
+// REDACTED.
+func (c *Configuration) Redacted(key string) string {
+	if isSecret(key) && c.Get(key) != "" {
+		return REDACTED
+	}
+
+	if key == CONF_WEBHOOK_URL && c.Get(key) != "" {
+		return RedactedURL(c.Get(key))
+	}
+
+	// Only the password of the proxy URL is a secret.
+	if key == CONF_PROXY {
+		if u, err := url.Parse(c.Get(key)); err == nil {
+			if _, ok := u.User.Password(); ok {
+				// String() would escape the parentheses of REDACTED.
+				return strings.Replace(u.Redacted(), ":xxxxx@", ":"+REDACTED+"@", 1)
+			}
+		}
+	}
+
+	return c.Get(key)
+}
 
-	result := make([]string, len(keys))
+// Return the URL with everything after the host redacted. Webhooks often
+// carry their secret in the path or the query.
+func RedactedURL(raw string) string {
+	u, err := url.Parse(raw)
 
-	for i, k := range keys {
-		result[i] = fmt.Sprintf("%s: %s", k, c.Get(k))
+	if err != nil || u.Host == "" {
+		return REDACTED
+	}
+
+	result := u.Scheme + "://" + u.Host
+
+	if strings.Trim(u.Path, "/") != "" || u.RawQuery != "" || u.Fragment != "" {
+		result += "/" + REDACTED
+	}
+
+	return result
+}
+
+// Dump the configuration as strings in the form `key: value`. The values of
+// secrets are redacted. Keys with several values are repeated.
+func (c *Configuration) DumpConfig() []string {
+	result := []string{}
+
+	for _, k := range c.Keys() {
+		for _, v := range strings.Split(c.Redacted(k), "\n") {
+			result = append(result, fmt.Sprintf("%s: %s", k, v))
+		}
 	}
 
 	return result
@@ -31,6 +31,11 @@ const (
 	CMD_USAGE = "usage"
 	CMD_RUN   = "run"
 
+	SOURCE_COMMAND_LINE = "command line"
+	SOURCE_MESSAGE      = "message"
+
+	ACCOUNT_SECTION_PREFIX = "account "
+
 	CONF_WORKDIR         = "workdir"
 	CONF_DATE            = "date"
 	CONF_DAYS            = "days"
@@ -44,6 +49,66 @@ const (
 	CONF_SMTP_SERVER     = "server"
 	CONF_SMTP_PORT       = "port"
 	CONF_SMTP_INSECURE   = "insecure"
+	CONF_SMTP_TLS        = "tls"
 	CONF_NOT_BEFORE      = "not-before"
 	CONF_NOT_AFTER       = "not-after"
+	CONF_TRANSPORT       = "transport"
+	CONF_ACCOUNT         = "account"
+	CONF_ENCRYPT         = "encrypt"
+	CONF_SIGN            = "sign"
+	CONF_SMIME_SIGN      = "smime-sign"
+	CONF_SMIME_ENCRYPT   = "smime-encrypt"
+	CONF_TRACE_HEADERS   = "trace-headers"
+	CONF_PARTIAL_FAILURE = "partial-failure"
+	CONF_ATTACH          = "attach"
+	CONF_FORMAT          = "format"
+
+	CONF_SMTP_USER                = "user"
+	CONF_SMTP_PASSWORD            = "password"
+	CONF_SMTP_PASSWORD_COMMAND    = "password-command"
+	CONF_NETRC                    = "netrc"
+	CONF_OAUTH_TOKEN_FILE         = "oauth-token-file"
+	CONF_OAUTH_TOKEN_URL          = "oauth-token-url"
+	CONF_SMTP_AUTH                = "auth"
+	CONF_SMTP_ALLOW_INSECURE_AUTH = "allow-insecure-auth"
+
+	CONF_TLS_CA_FILE     = "ca-file"
+	CONF_TLS_SERVER_NAME = "tls-server-name"
+	CONF_TLS_PIN_SHA256  = "tls-pin-sha256"
+	CONF_TLS_CLIENT_CERT = "client-cert"
+	CONF_TLS_CLIENT_KEY  = "client-key"
+
+	CONF_PROXY = "proxy"
+
+	CONF_CONNECT_TIMEOUT = "connect-timeout"
+	CONF_COMMAND_TIMEOUT = "command-timeout"
+	CONF_RUN_TIMEOUT     = "run-timeout"
+
+	CONF_SENDMAIL_COMMAND = "sendmail-command"
+	CONF_MAILDIR          = "maildir"
+	CONF_MBOX             = "mbox"
+	CONF_LMTP             = "lmtp"
+
+	CONF_DKIM_DOMAIN   = "dkim-domain"
+	CONF_DKIM_SELECTOR = "dkim-selector"
+	CONF_DKIM_KEY      = "dkim-key"
+
+	CONF_PGP_KEYRING    = "pgp-keyring"
+	CONF_PGP_PASSPHRASE = "pgp-passphrase"
+
+	CONF_SMIME_CERT     = "smime-cert"
+	CONF_SMIME_KEY      = "smime-key"
+	CONF_SMIME_CERT_DIR = "smime-cert-dir"
+
+	CONF_RETRY_LIMIT = "retry-limit"
+	CONF_RETRY_DELAY = "retry-delay"
+
+	CONF_MAX_PER_RUN               = "max-per-run"
+	CONF_MAX_PER_MINUTE            = "max-per-minute"
+	CONF_MAX_PER_RECIPIENT_PER_DAY = "max-per-recipient-per-day"
+
+	CONF_WEBHOOK_URL           = "webhook-url"
+	CONF_WEBHOOK_TEMPLATE      = "webhook-template"
+	CONF_WEBHOOK_TOKEN         = "webhook-token"
+	CONF_WEBHOOK_HEADER_PREFIX = "webhook-header-"
 )
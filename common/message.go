@@ -23,12 +23,20 @@ import (
 	"net/mail"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 type Message struct {
 	Conf Configuration
 	Body []string
 	Name string
+
+	// The folder of the message file. Attachments given with a relative
+	// path are looked up there.
+	Dir string
+
+	// Problems found while merging the configuration, reported by Verify().
+	mergeErrors []error
 }
 
 // Supporting sort.Interface.
@@ -118,6 +126,7 @@ func NewMessageFromFile(path string) (Message, error) {
 		Body: msgBody,
 		Conf: configuration,
 		Name: filepath.Base(path),
+		Dir:  filepath.Dir(path),
 	}, nil
 }
 
@@ -131,9 +140,11 @@ func (m *Message) WriteToFile(file string) error {
 
 	defer f.Close()
 
-	for _, s := range m.Conf.DumpConfig() {
-		f.WriteString(s)
-		f.WriteString("\n")
+	// Not DumpConfig, as the message has to be written as it is.
+	for _, k := range m.Conf.Keys() {
+		for _, v := range strings.Split(m.Get(k), "\n") {
+			f.WriteString(fmt.Sprintf("%s: %s\n", k, v))
+		}
 	}
 
 	f.WriteString("\n")
@@ -146,6 +157,67 @@ func (m *Message) WriteToFile(file string) error {
 	return nil
 }
 
+// Parameters that may be set in the configuration part of a message. These take
+// precedence over the global configuration and the command line.
+var messageKeys = []string{
+	CONF_DATE,
+	CONF_SUBJECT,
+	CONF_TO,
+	CONF_FROM,
+	CONF_REPLY_TO,
+	CONF_CC,
+	CONF_BCC,
+	CONF_SMTP_TLS,
+	CONF_TRANSPORT,
+	CONF_ACCOUNT,
+	CONF_ENCRYPT,
+	CONF_SIGN,
+	CONF_SMIME_SIGN,
+	CONF_SMIME_ENCRYPT,
+	CONF_TRACE_HEADERS,
+	CONF_PARTIAL_FAILURE,
+	CONF_ATTACH,
+	CONF_FORMAT,
+}
+
+// Merge the global configuration `conf` into the message's configuration.
+// Message parameters (see `messageKeys`) set in the message are kept,
+// everything else is taken from `conf`. If the message uses an account, its
+// section of the INI is merged as well.
+func (m *Message) MergeWith(conf *Configuration) {
+	own := map[string]string{}
+
+	for k, v := range m.Conf.Data {
+		own[k] = v
+	}
+
+	m.Conf.MergeWith(conf)
+
+	for k, v := range own {
+		_, global := conf.Data[k]
+
+		if !global || isMessageKey(k) {
+			m.Conf.SetFrom(k, v, SOURCE_MESSAGE)
+		}
+	}
+
+	if account := m.Get(CONF_ACCOUNT); account != "" {
+		if err := m.Conf.MergeWithAccount(account); err != nil {
+			m.mergeErrors = append(m.mergeErrors, err)
+		}
+	}
+}
+
+func isMessageKey(key string) bool {
+	for _, k := range messageKeys {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Return the specified configuration key's value.
 func (m *Message) Get(key string) string {
 	return m.Conf.Data[key]
@@ -185,7 +257,7 @@ func verifyAddress(paramName string, address string) error {
 // Verify if a message has all necessary parameters. We need at least to, from,
 // subject, and date. This will also verify optional address lists, etc.
 func (m *Message) Verify() []error {
-	errors := []error{}
+	errors := append([]error{}, m.mergeErrors...)
 
 	if err := verifyAddress("from", m.Get("from")); err != nil {
 		errors = append(errors, err)
@@ -223,6 +295,30 @@ func (m *Message) Verify() []error {
 		errors = append(errors, err)
 	}
 
+	if limit, err := m.Conf.GetInt(CONF_RETRY_LIMIT); err != nil {
+		errors = append(errors, err)
+	} else if limit < 0 {
+		errors = append(errors, fmt.Errorf("'%s' must not be negative", CONF_RETRY_LIMIT))
+	}
+
+	if delay, err := m.Conf.GetDuration(CONF_RETRY_DELAY); err != nil {
+		errors = append(errors, err)
+	} else if delay < 0 {
+		errors = append(errors, fmt.Errorf("'%s' must not be negative", CONF_RETRY_DELAY))
+	}
+
+	for _, key := range []string{CONF_CONNECT_TIMEOUT, CONF_COMMAND_TIMEOUT, CONF_RUN_TIMEOUT} {
+		if timeout, err := m.Conf.GetDuration(key); err != nil {
+			errors = append(errors, err)
+		} else if timeout < 0 {
+			errors = append(errors, fmt.Errorf("'%s' must not be negative", key))
+		}
+	}
+
+	if _, err := m.Conf.GetBool(CONF_TRACE_HEADERS); err != nil {
+		errors = append(errors, err)
+	}
+
 	if len(errors) == 0 {
 		return nil
 	}
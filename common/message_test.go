@@ -34,7 +34,7 @@ func TestReadMessagesAndVerify(t *testing.T) {
 
 	for _, message := range messages {
 		// If we don't to this, it will fail because "from" is missing
-		message.Conf.MergeWith(conf)
+		message.MergeWith(conf)
 
 		if err := message.Verify(); err != nil {
 			t.Errorf("Verification of message '%s' failed with %s", message.Name, err)
@@ -80,3 +80,39 @@ func TestMessagesSort(t *testing.T) {
 		}
 	}
 }
+
+func TestMessage_MergeWith(t *testing.T) {
+	message := NewMessage()
+	message.Conf.Set("to", "me@example.com")
+	message.Conf.Set("tls", "none")
+	message.Conf.Set("workdir", "/tmp")
+
+	conf := NewConfiguration()
+	conf.Set("to", "you@example.com")
+	conf.Set("from", "me@example.com")
+	conf.Set("tls", "starttls")
+	conf.Set("workdir", "/home/me/lettersnail")
+
+	message.MergeWith(conf)
+
+	// Message parameters take precedence...
+	assert.Equal(t, "me@example.com", message.Get("to"))
+	assert.Equal(t, "none", message.Get("tls"))
+
+	// ...everything else is taken from the global configuration.
+	assert.Equal(t, "me@example.com", message.Get("from"))
+	assert.Equal(t, "/home/me/lettersnail", message.Get("workdir"))
+}
+
+func TestMessage_MergeWithUnknownAccount(t *testing.T) {
+	message := NewMessage()
+	message.Conf.Set("account", "work")
+
+	conf := NewConfiguration()
+	conf.Set("config", filepath.Join("testdata", "missing.ini"))
+
+	message.MergeWith(conf)
+
+	assert.Equal(t, SOURCE_MESSAGE, message.Conf.Source("account"))
+	assert.NotNil(t, message.Verify())
+}
@@ -1,13 +1,24 @@
 module github.com/githubert/lettersnail
 
-go 1.15
+go 1.19
 
 require (
-	github.com/davecgh/go-spew v0.0.0-20151105211317-5215b55f46b2 // indirect
+	github.com/ProtonMail/go-crypto v1.1.6
 	github.com/docopt/docopt.go v0.0.0-20180111231733-ee0de3bc6815
 	github.com/go-ini/ini v1.62.0
 	github.com/jordan-wright/email v4.0.1-0.20210109023952-943e75fe5223+incompatible
+	github.com/stretchr/testify v0.0.0-20160504130155-6cb3b85ef5a0
+	github.com/yuin/goldmark v1.7.8
+	// Archived, but it does what is needed. Its global cipher setting is
+	// set once, in cmd/smime.go.
+	go.mozilla.org/pkcs7 v0.9.0
+)
+
+require (
+	github.com/cloudflare/circl v1.3.7 // indirect
+	github.com/davecgh/go-spew v0.0.0-20151105211317-5215b55f46b2 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/smartystreets/goconvey v1.6.4 // indirect
-	github.com/stretchr/testify v0.0.0-20160504130155-6cb3b85ef5a0
+	golang.org/x/crypto v0.17.0 // indirect
+	golang.org/x/sys v0.16.0 // indirect
 )
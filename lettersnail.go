@@ -47,6 +47,7 @@ The following commands are available:
           email message.
   create  Open a new message in an editor.
   run     Send out pending messages.
+  retry   Move failed messages back into the queue.
 ` // end::main[]
 
 var defaultConf = Configuration{
@@ -146,7 +147,7 @@ func main() {
 	// Determine configuration file name, defaults to `lettersnail.ini` in
 	// the user's config home (usually `.config`).
 	if args["--config"] != nil {
-		sessionConf.Set(CONF_CONFIG_FILENAME, args["--config"].(string))
+		sessionConf.SetFrom(CONF_CONFIG_FILENAME, args["--config"].(string), SOURCE_COMMAND_LINE)
 	} else {
 		sessionConf.Set(CONF_CONFIG_FILENAME, filepath.Join(configHome(), "lettersnail.ini"))
 	}
@@ -162,7 +163,7 @@ func main() {
 	// the user's home directory. '--workdir' on the command line takes
 	// precedence over the 'workdir' in the INI.
 	if args["--workdir"] != nil {
-		sessionConf.Set(CONF_WORKDIR, args["--workdir"].(string))
+		sessionConf.SetFrom(CONF_WORKDIR, args["--workdir"].(string), SOURCE_COMMAND_LINE)
 	} else {
 		// If no working directory is set in the INI...
 		if sessionConf.Get(CONF_WORKDIR) == "" {
@@ -176,8 +177,11 @@ func main() {
 	// Make sure that all necessary folders exist.
 	createFolders(sessionConf.Get(CONF_WORKDIR))
 
-	// See if there are files in DIR_ERRORS and alert the user.
-	alertIfErrors(sessionConf.Get(CONF_WORKDIR))
+	// See if there are files in DIR_ERRORS and alert the user. Not for
+	// `retry`, which is about to move them out of there.
+	if command != "retry" {
+		alertIfErrors(sessionConf.Get(CONF_WORKDIR))
+	}
 
 	commandArgs  := []string{command}
 	commandArgs = append(commandArgs, args["<args>"].([]string)...)
@@ -193,5 +197,7 @@ func main() {
 		cmd.Run(commandArgs, sessionConf)
 	case "debug":
 		cmd.Debug(commandArgs, sessionConf)
+	case "retry":
+		cmd.Retry(commandArgs, sessionConf)
 	}
 }
\ No newline at end of file